@@ -0,0 +1,237 @@
+package main
+
+import (
+	"container/list"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Answers are cached at most for a day, negative answers for 3 hours, as RFC
+// 2308 recommends.
+const (
+	cacheMaxTtl         = 24 * time.Hour
+	cacheMaxNegativeTtl = 3 * time.Hour
+)
+
+// Cached response and the time it was stored and expires.
+type cacheEntry struct {
+	key     string
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+}
+
+// Query which is being forwarded, the identical ones wait for its result.
+type cacheCall struct {
+	done chan struct{}
+	msg  *dns.Msg
+	err  error
+}
+
+// Cache of forwarded responses, holding at most size of them. The least
+// recently used response is dropped when it's full.
+type responseCache struct {
+	lock    sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List
+	calls   map[string]*cacheCall
+
+	hits    uint64
+	misses  uint64
+	shared  uint64
+	evicted uint64
+}
+
+func newResponseCache(size int) *responseCache {
+	return &responseCache{
+		size:    size,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		calls:   make(map[string]*cacheCall),
+	}
+}
+
+// Returns the cache key of the request. Names are case-insensitive, the EDNS0
+// and DNSSEC bits change what the nameserver answers.
+func getCacheKey(r *dns.Msg) string {
+	q := r.Question[0]
+	key := strings.ToLower(q.Name) + " " + strconv.Itoa(int(q.Qtype)) + " " + strconv.Itoa(int(q.Qclass))
+	if opt := r.IsEdns0(); opt != nil {
+		key += " edns"
+		if opt.Do() {
+			key += " do"
+		}
+	}
+	if r.CheckingDisabled {
+		key += " cd"
+	}
+	return key
+}
+
+// Returns how long the response can be cached: the lowest TTL of its records,
+// or for NXDOMAIN and NODATA the lower of the SOA TTL and minimum (RFC 2308).
+// Zero means the response must not be cached.
+func getCacheTtl(m *dns.Msg) time.Duration {
+	if m.Truncated || (m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError) {
+		return 0
+	}
+
+	if m.Rcode == dns.RcodeNameError || len(m.Answer) == 0 {
+		for _, rr := range m.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				ttl := soa.Hdr.Ttl
+				if soa.Minttl < ttl {
+					ttl = soa.Minttl
+				}
+				if d := time.Duration(ttl) * time.Second; d < cacheMaxNegativeTtl {
+					return d
+				}
+				return cacheMaxNegativeTtl
+			}
+		}
+		return 0
+	}
+
+	ttl := cacheMaxTtl
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if d := time.Duration(rr.Header().Ttl) * time.Second; d < ttl {
+				ttl = d
+			}
+		}
+	}
+	return ttl
+}
+
+// Returns the cached response to the request, or forwards the request by
+// exchange and caches the response. Identical requests forwarded at the same
+// time over the same network wait for the first one instead of asking the
+// nameservers again; a TCP client must not get a truncated UDP answer.
+func (c *responseCache) exchange(r *dns.Msg, network string, exchange func() (*dns.Msg, error)) (*dns.Msg, error) {
+	key := getCacheKey(r)
+	callKey := key + " " + network
+
+	c.lock.Lock()
+	if m := c.get(key); m != nil {
+		c.hits++
+		c.lock.Unlock()
+		return reply(r, m), nil
+	}
+	if call, ok := c.calls[callKey]; ok {
+		c.shared++
+		c.lock.Unlock()
+		<-call.done
+		if call.err != nil {
+			return nil, call.err
+		}
+		return reply(r, call.msg.Copy()), nil
+	}
+	c.misses++
+	call := &cacheCall{done: make(chan struct{})}
+	c.calls[callKey] = call
+	c.lock.Unlock()
+
+	call.msg, call.err = exchange()
+
+	c.lock.Lock()
+	delete(c.calls, callKey)
+	if call.err == nil {
+		if ttl := getCacheTtl(call.msg); ttl > 0 {
+			c.add(key, call.msg.Copy(), ttl)
+		}
+	}
+	c.lock.Unlock()
+	close(call.done)
+
+	if call.err != nil {
+		return nil, call.err
+	}
+	return reply(r, call.msg.Copy()), nil
+}
+
+// Returns copy of the cached response with TTLs lowered by the time it spent
+// in the cache, nil if it's not there or expired. Caller must hold the lock.
+func (c *responseCache) get(key string) *dns.Msg {
+	e, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := e.Value.(*cacheEntry)
+	now := time.Now()
+	if !now.Before(entry.expires) {
+		c.lru.Remove(e)
+		delete(c.entries, key)
+		return nil
+	}
+	c.lru.MoveToFront(e)
+
+	m := entry.msg.Copy()
+	elapsed := uint32(now.Sub(entry.stored) / time.Second)
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if hdr.Ttl > elapsed {
+				hdr.Ttl -= elapsed
+			} else {
+				hdr.Ttl = 0
+			}
+		}
+	}
+	return m
+}
+
+// Caller must hold the lock.
+func (c *responseCache) add(key string, m *dns.Msg, ttl time.Duration) {
+	now := time.Now()
+	entry := &cacheEntry{key: key, msg: m, stored: now, expires: now.Add(ttl)}
+	if e, ok := c.entries[key]; ok {
+		e.Value = entry
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		last := c.lru.Back()
+		c.lru.Remove(last)
+		delete(c.entries, last.Value.(*cacheEntry).key)
+		c.evicted++
+	}
+}
+
+// Drops all the cached responses, e.g. after the nameservers changed.
+func (c *responseCache) clear() {
+	defer c.lock.Unlock()
+	c.lock.Lock()
+
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+}
+
+// Logs the hit and miss counts, for print-status.
+func (c *responseCache) logStatus() {
+	defer c.lock.Unlock()
+	c.lock.Lock()
+
+	log.Println("cache:", c.lru.Len(), "of", c.size, "responses, hits:", c.hits, "misses:", c.misses,
+		"shared:", c.shared, "evicted:", c.evicted)
+}
+
+// Turns copy of the response into a reply to the request, with its id and
+// question.
+func reply(r *dns.Msg, m *dns.Msg) *dns.Msg {
+	m.Id = r.Id
+	m.Question = append([]dns.Question(nil), r.Question...)
+	return m
+}
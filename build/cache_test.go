@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func createResponse(name string, rcode int, answer []dns.RR, ns []dns.RR) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetQuestion(name, dns.TypeA)
+	m := new(dns.Msg)
+	m.SetRcode(r, rcode)
+	m.Answer = answer
+	m.Ns = ns
+	return m
+}
+
+func TestGetCacheTtl(t *testing.T) {
+	a := func(ttl uint32) dns.RR {
+		return &dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}}
+	}
+	soa := func(ttl uint32, minttl uint32) dns.RR {
+		return &dns.SOA{Hdr: dns.RR_Header{Name: "com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl}, Minttl: minttl}
+	}
+	truncated := createResponse("example.com.", dns.RcodeSuccess, []dns.RR{a(300)}, nil)
+	truncated.Truncated = true
+
+	inputs := []struct {
+		name     string
+		m        *dns.Msg
+		expected time.Duration
+	}{
+		{"lowest ttl", createResponse("example.com.", dns.RcodeSuccess, []dns.RR{a(300), a(60)}, nil), 60 * time.Second},
+		{"zero ttl", createResponse("example.com.", dns.RcodeSuccess, []dns.RR{a(300), a(0)}, nil), 0},
+		{"long ttl", createResponse("example.com.", dns.RcodeSuccess, []dns.RR{a(1 << 30)}, nil), cacheMaxTtl},
+		{"nxdomain", createResponse("example.com.", dns.RcodeNameError, nil, []dns.RR{soa(900, 60)}), 60 * time.Second},
+		{"nodata", createResponse("example.com.", dns.RcodeSuccess, nil, []dns.RR{soa(30, 60)}), 30 * time.Second},
+		{"long negative ttl", createResponse("example.com.", dns.RcodeNameError, nil, []dns.RR{soa(1<<30, 1<<30)}), cacheMaxNegativeTtl},
+		{"negative without soa", createResponse("example.com.", dns.RcodeNameError, nil, nil), 0},
+		{"servfail", createResponse("example.com.", dns.RcodeServerFailure, nil, []dns.RR{soa(900, 60)}), 0},
+		{"truncated", truncated, 0},
+	}
+
+	for _, input := range inputs {
+		if ttl := getCacheTtl(input.m); ttl != input.expected {
+			t.Error(input.name, "Expected:", input.expected, "Got:", ttl)
+		}
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	c := newResponseCache(2)
+
+	calls := 0
+	exchange := func(name string, rcode int) func() (*dns.Msg, error) {
+		return func() (*dns.Msg, error) {
+			calls++
+			var answer, ns []dns.RR
+			if rcode == dns.RcodeSuccess {
+				answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}}}
+			} else {
+				ns = []dns.RR{&dns.SOA{Hdr: dns.RR_Header{Name: "com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 900}, Minttl: 60}}
+			}
+			return createResponse(name, rcode, answer, ns), nil
+		}
+	}
+
+	r := new(dns.Msg)
+	r.SetQuestion("www.example.com.", dns.TypeA)
+	c.exchange(r, "udp", exchange("www.example.com.", dns.RcodeSuccess))
+
+	// Names are matched case-insensitively, the reply has the id and question
+	// of the request.
+	r = new(dns.Msg)
+	r.SetQuestion("WWW.Example.com.", dns.TypeA)
+	in, err := c.exchange(r, "udp", exchange("www.example.com.", dns.RcodeSuccess))
+	if err != nil || calls != 1 {
+		t.Fatal("Expected answer from the cache, Got:", in, err, "calls:", calls)
+	}
+	if in.Id != r.Id || in.Question[0].Name != "WWW.Example.com." {
+		t.Error("Expected reply to the request, Got:", in)
+	}
+
+	// TTLs go down while the answer is in the cache.
+	c.entries[getCacheKey(r)].Value.(*cacheEntry).stored = time.Now().Add(-100 * time.Second)
+	if in, _ = c.exchange(r, "udp", exchange("www.example.com.", dns.RcodeSuccess)); in.Answer[0].Header().Ttl != 200 {
+		t.Error("Expected TTL 200, Got:", in.Answer[0].Header().Ttl)
+	}
+
+	// Negative answers are cached too.
+	r.SetQuestion("nx.example.com.", dns.TypeA)
+	c.exchange(r, "udp", exchange("nx.example.com.", dns.RcodeNameError))
+	if in, _ = c.exchange(r, "udp", exchange("nx.example.com.", dns.RcodeNameError)); calls != 2 || in.Rcode != dns.RcodeNameError {
+		t.Error("Expected NXDOMAIN from the cache, Got:", in, "calls:", calls)
+	}
+
+	// Expired answers are asked again.
+	c.entries[getCacheKey(r)].Value.(*cacheEntry).expires = time.Now()
+	if c.exchange(r, "udp", exchange("nx.example.com.", dns.RcodeNameError)); calls != 3 {
+		t.Error("Expired answer should be forwarded, calls:", calls)
+	}
+
+	// The least recently used answer is dropped when the cache is full.
+	r.SetQuestion("other.example.com.", dns.TypeA)
+	c.exchange(r, "udp", exchange("other.example.com.", dns.RcodeSuccess))
+	r.SetQuestion("www.example.com.", dns.TypeA)
+	if c.exchange(r, "udp", exchange("www.example.com.", dns.RcodeSuccess)); calls != 5 {
+		t.Error("Least recently used answer should be dropped, calls:", calls)
+	}
+	if c.hits != 3 || c.misses != 5 || c.evicted != 2 {
+		t.Error("Unexpected statistics, hits:", c.hits, "misses:", c.misses, "evicted:", c.evicted)
+	}
+
+	// Errors are not cached.
+	r.SetQuestion("error.example.com.", dns.TypeA)
+	for i := 0; i < 2; i++ {
+		if _, err := c.exchange(r, "udp", func() (*dns.Msg, error) { calls++; return nil, errors.New("timeout") }); err == nil {
+			t.Error("Expected error")
+		}
+	}
+	if calls != 7 {
+		t.Error("Errors should not be cached, calls:", calls)
+	}
+}
+
+func TestResponseCacheShared(t *testing.T) {
+	c := newResponseCache(10)
+
+	var lock sync.Mutex
+	calls := 0
+	release := make(chan struct{})
+	exchange := func() (*dns.Msg, error) {
+		lock.Lock()
+		calls++
+		lock.Unlock()
+		<-release
+		// Zero TTL, only the identical requests in flight share the answer.
+		return createResponse("example.com.", dns.RcodeSuccess, []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET}}}, nil), nil
+	}
+
+	var wg sync.WaitGroup
+	ids := make(chan bool, 10)
+	for i := 0; i < 10; i++ {
+		// TCP clients must not wait for a possibly truncated UDP answer
+		network := "udp"
+		if i%2 == 1 {
+			network = "tcp"
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := new(dns.Msg)
+			r.SetQuestion("example.com.", dns.TypeA)
+			in, err := c.exchange(r, network, exchange)
+			ids <- err == nil && in.Id == r.Id && len(in.Answer) == 1
+		}()
+	}
+
+	// Allow some time for the requests to wait for the first one
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(ids)
+
+	for ok := range ids {
+		if !ok {
+			t.Error("Every request should get the answer with its own id")
+		}
+	}
+	if calls != 2 || c.shared != 8 {
+		t.Error("Expected one forwarded request per network, Got:", calls, "shared:", c.shared)
+	}
+}
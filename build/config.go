@@ -1,14 +1,20 @@
 package main
 
 import (
+	"encoding/base64"
+	"errors"
+	"net"
 	"os"
+	"strconv"
 	"strings"
+
+	"github.com/miekg/dns"
 )
 
 type Domain []string
 
 func NewDomain(s string) Domain {
-	s = strings.Replace(s, "..", ".", -1)
+	s = strings.ToLower(strings.Replace(s, "..", ".", -1))
 	if s[:1] == "." {
 		s = s[1:]
 	}
@@ -23,13 +29,30 @@ func (d *Domain) String() string {
 }
 
 type Config struct {
-	nameserver string
-	dnsAddr    string
-	domain     Domain
-	dockerHost string
-	verbose    bool
-	debug      bool
-	ttl        int
+	nameservers     []string
+	resolvConf      string
+	search          bool
+	forwardStrategy string
+	forwardRules    []ForwardRule
+	dnsAddr         string
+	domain          Domain
+	nsName          string
+	nsAddr          string
+	allowTransfer   []*net.IPNet
+	notify          []string
+	tsigKeys        map[string]string
+	txt             bool
+	txtLabels       []string
+	maxUDPSize      int
+	minimalAny      bool
+	order           string
+	maxAnswers      int
+	cacheSize       int
+	dnssecKeys      string
+	dockerHost      string
+	verbose         bool
+	debug           bool
+	ttl             int
 }
 
 func NewConfig() *Config {
@@ -39,10 +62,164 @@ func NewConfig() *Config {
 	}
 
 	return &Config{
-		nameserver: "8.8.8.8:53",
-		dnsAddr:    ":53",
-		domain:     NewDomain("docker"),
-		dockerHost: dockerHost,
+		resolvConf:      "/etc/resolv.conf",
+		forwardStrategy: forwardSequential,
+		dnsAddr:         ":53",
+		domain:          NewDomain("docker"),
+		dockerHost:      dockerHost,
+		txt:             true,
+		maxUDPSize:      4096,
+		cacheSize:       10000,
+		order:           orderRandom,
+	}
+
+}
+
+// Parses comma separated list of networks in CIDR notation. Plain IP addresses
+// are taken as single host networks.
+func ParseNetworks(s string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, errors.New("Invalid IP address: " + item)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, errors.New("Invalid network: " + item)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// Splits comma separated list of host:port addresses. Port 53 is used when
+// the address doesn't have one.
+func ParseAddresses(s string) []string {
+	var addrs []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(item); err != nil {
+			item = net.JoinHostPort(strings.Trim(item, "[]"), "53")
+		}
+		addrs = append(addrs, item)
 	}
+	return addrs
+}
+
+// Parses comma separated list of TSIG keys in the name:secret form, where
+// secret is base64 encoded. Returns map of secrets keyed by fully qualified
+// key name, as miekg/dns wants them.
+func ParseTsigKeys(s string) (map[string]string, error) {
+	keys := make(map[string]string)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.New("Invalid TSIG key, expected name:secret: " + item)
+		}
+		if _, err := base64.StdEncoding.DecodeString(parts[1]); err != nil {
+			return nil, errors.New("Invalid TSIG secret of key " + parts[0] + ": " + err.Error())
+		}
+		keys[dns.Fqdn(strings.ToLower(parts[0]))] = parts[1]
+	}
+	return keys, nil
+}
+
+// Checks the answer ordering strategy from the command line.
+func ParseOrder(s string) (string, error) {
+	switch s {
+	case orderRandom, orderRoundRobin, orderWeighted:
+		return s, nil
+	}
+	return "", errors.New("Unknown answer order " + s + ", expected random, round-robin or weighted")
+}
 
+// Checks the forwarding strategy from the command line.
+func ParseForwardStrategy(s string) (string, error) {
+	switch s {
+	case forwardSequential, forwardParallel:
+		return s, nil
+	}
+	return "", errors.New("Unknown forward strategy " + s + ", expected sequential or parallel")
+}
+
+// ForwardRule sends queries for names under the domain to its nameservers.
+type ForwardRule struct {
+	Domain      string
+	Nameservers []string
+}
+
+// Parses forwarding rules "domain=nameserver,nameserver;domain=nameserver",
+// e.g. "corp.example.com=10.8.0.1;consul=127.0.0.1:8600".
+func ParseForwardRules(s string) ([]ForwardRule, error) {
+	var rules []ForwardRule
+	for _, item := range strings.Split(s, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("Invalid forward rule, expected domain=nameservers: " + item)
+		}
+		rule, err := newForwardRule(parts[0], ParseAddresses(parts[1]))
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// Reads forwarding rules from the file, one "domain nameserver..." rule per
+// line. Empty lines and lines starting with # are skipped.
+func ReadForwardRules(path string) ([]ForwardRule, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []ForwardRule
+	for i, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		rule, err := newForwardRule(fields[0], ParseAddresses(strings.Join(fields[1:], ",")))
+		if err != nil {
+			return nil, errors.New(path + ":" + strconv.Itoa(i+1) + ": " + err.Error())
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func newForwardRule(domain string, nameservers []string) (ForwardRule, error) {
+	domain = dns.Fqdn(strings.ToLower(strings.TrimSpace(domain)))
+	if _, ok := dns.IsDomainName(domain); !ok {
+		return ForwardRule{}, errors.New("Invalid domain of forward rule: " + domain)
+	}
+	if len(nameservers) == 0 {
+		return ForwardRule{}, errors.New("Forward rule for " + domain + " has no nameservers")
+	}
+	return ForwardRule{Domain: domain, Nameservers: nameservers}, nil
 }
@@ -1,6 +1,11 @@
 package main
 
 import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -21,3 +26,134 @@ func TestDomainCreation(t *testing.T) {
 		}
 	}
 }
+
+func TestParseNetworks(t *testing.T) {
+	networks, err := ParseNetworks("10.0.0.0/8, 192.168.1.5,2001:db8::/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(networks) != 3 {
+		t.Fatal("Expected 3 networks, got", networks)
+	}
+
+	inputs := map[string]bool{
+		"10.1.2.3":    true,
+		"192.168.1.5": true,
+		"192.168.1.6": false,
+		"2001:db8::1": true,
+		"2001:db9::1": false,
+	}
+	for input, expected := range inputs {
+		actual := false
+		for _, network := range networks {
+			if network.Contains(net.ParseIP(input)) {
+				actual = true
+			}
+		}
+		if actual != expected {
+			t.Error(input, "Expected:", expected, "Got:", actual)
+		}
+	}
+
+	if networks, err = ParseNetworks(""); err != nil || len(networks) != 0 {
+		t.Error("Empty list should parse to no networks", networks, err)
+	}
+
+	if _, err = ParseNetworks("10.0.0.0/8,nonsense"); err == nil {
+		t.Error("Invalid network should fail")
+	}
+}
+
+func TestParseAddresses(t *testing.T) {
+	input := "10.0.0.1, 10.0.0.2:5353,[2001:db8::1]:53,2001:db8::2,,"
+	expected := []string{"10.0.0.1:53", "10.0.0.2:5353", "[2001:db8::1]:53", "[2001:db8::2]:53"}
+	actual := ParseAddresses(input)
+	if !reflect.DeepEqual(actual, expected) {
+		t.Error(input, "Expected:", expected, "Got:", actual)
+	}
+}
+
+func TestParseTsigKeys(t *testing.T) {
+	keys, err := ParseTsigKeys("Update.Key:c2VjcmV0, other.key.:b3RoZXI=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"update.key.": "c2VjcmV0", "other.key.": "b3RoZXI="}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Error("Expected:", expected, "Got:", keys)
+	}
+
+	for _, input := range []string{"nosecret", ":c2VjcmV0", "key:not base64!"} {
+		if _, err := ParseTsigKeys(input); err == nil {
+			t.Error(input, "should fail")
+		}
+	}
+}
+
+func TestParseOrder(t *testing.T) {
+	for _, order := range []string{"random", "round-robin", "weighted"} {
+		if actual, err := ParseOrder(order); err != nil || actual != order {
+			t.Error(order, "should be valid, Got:", actual, err)
+		}
+	}
+	if _, err := ParseOrder("fastest"); err == nil {
+		t.Error("Unknown order should be rejected")
+	}
+}
+
+func TestParseForwardStrategy(t *testing.T) {
+	for _, strategy := range []string{"sequential", "parallel"} {
+		if actual, err := ParseForwardStrategy(strategy); err != nil || actual != strategy {
+			t.Error(strategy, "should be valid, Got:", actual, err)
+		}
+	}
+	if _, err := ParseForwardStrategy("random"); err == nil {
+		t.Error("Unknown strategy should be rejected")
+	}
+}
+
+func TestParseForwardRules(t *testing.T) {
+	rules, err := ParseForwardRules("Corp.Example.com=10.8.0.1,10.8.0.2:5353; consul.=127.0.0.1:8600")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ForwardRule{
+		{"corp.example.com.", []string{"10.8.0.1:53", "10.8.0.2:5353"}},
+		{"consul.", []string{"127.0.0.1:8600"}},
+	}
+	if !reflect.DeepEqual(rules, expected) {
+		t.Error("Expected:", expected, "Got:", rules)
+	}
+
+	for _, input := range []string{"corp.example.com", "corp.example.com=", "bad..domain=10.8.0.1"} {
+		if _, err := ParseForwardRules(input); err == nil {
+			t.Error(input, "should fail")
+		}
+	}
+}
+
+func TestReadForwardRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "forward-rules")
+	content := "# split DNS\ncorp.example.com 10.8.0.1 10.8.0.2\n\nconsul 127.0.0.1:8600\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := ReadForwardRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ForwardRule{
+		{"corp.example.com.", []string{"10.8.0.1:53", "10.8.0.2:53"}},
+		{"consul.", []string{"127.0.0.1:8600"}},
+	}
+	if !reflect.DeepEqual(rules, expected) {
+		t.Error("Expected:", expected, "Got:", rules)
+	}
+
+	if err := os.WriteFile(path, []byte("corp.example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadForwardRules(path); err == nil || !strings.HasPrefix(err.Error(), path+":1: ") {
+		t.Error("Expected error with the line number, Got:", err)
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// TTL of the DNSKEY records. Validators fetch them for every answer they
+// check, so they shouldn't follow the -ttl of the containers, which is 0 by
+// default.
+const dnskeyTtl = 3600
+
+// Signatures are valid for a week, from an hour ago to allow for clock skew.
+// Cached signatures are refreshed once half of the validity is gone.
+const (
+	signatureValidity = 7 * 24 * time.Hour
+	signatureSkew     = time.Hour
+)
+
+// Maximum number of cached signatures. Shuffled and cut answers are
+// different RRsets, the cache is dropped when there are too many of them.
+const maxSignatures = 10000
+
+// Signing key with its DNSKEY record.
+type signingKey struct {
+	dnskey *dns.DNSKEY
+	signer crypto.Signer
+}
+
+// Key signing key signs the DNSKEY RRset, zone signing key all the other
+// RRsets.
+type zoneKeys struct {
+	ksk signingKey
+	zsk signingKey
+
+	lock       sync.Mutex
+	signatures map[string]*dns.RRSIG
+}
+
+// Loads the KSK and ZSK of the zone from the directory, or generates them
+// there when they don't exist yet. The keys are ECDSA P-256 (algorithm 13).
+// Zone transfers are not signed, so signing can't be combined with
+// secondaries: they would serve the zone unsigned under the DS of the parent,
+// and validating resolvers would take their answers as bogus.
+func (s *DNSServer) LoadKeys(dir string) error {
+	zone := dns.Fqdn(s.config.domain.String())
+	if len(s.config.allowTransfer) > 0 || len(s.config.notify) > 0 {
+		return errors.New("DNSSEC signing can't be used with -allow-transfer or -notify, zone transfers are not signed")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	keys := &zoneKeys{signatures: make(map[string]*dns.RRSIG)}
+	var err error
+	if keys.ksk, err = loadKey(filepath.Join(dir, zone+"ksk"), zone, 257); err != nil {
+		return err
+	}
+	if keys.zsk, err = loadKey(filepath.Join(dir, zone+"zsk"), zone, 256); err != nil {
+		return err
+	}
+	s.keys = keys
+
+	log.Println("Signing zone", zone, "with KSK", keys.ksk.dnskey.KeyTag(), "and ZSK", keys.zsk.dnskey.KeyTag())
+	log.Println("DS record for the parent zone:", keys.ksk.dnskey.ToDS(dns.SHA256))
+	return nil
+}
+
+// Reads the key from path.key and path.private, or generates new one.
+func loadKey(path string, zone string, flags uint16) (key signingKey, err error) {
+	public, err := os.ReadFile(path + ".key")
+	if os.IsNotExist(err) {
+		return generateKey(path, zone, flags)
+	}
+	if err != nil {
+		return key, err
+	}
+
+	rr, err := dns.NewRR(string(public))
+	if err != nil {
+		return key, err
+	}
+	dnskey, ok := rr.(*dns.DNSKEY)
+	if !ok || !strings.EqualFold(dnskey.Hdr.Name, zone) || dnskey.Flags != flags {
+		return key, errors.New(path + ".key is not a DNSKEY of " + zone)
+	}
+
+	f, err := os.Open(path + ".private")
+	if err != nil {
+		return key, err
+	}
+	defer f.Close()
+	private, err := dnskey.ReadPrivateKey(f, path+".private")
+	if err != nil {
+		return key, err
+	}
+	signer, ok := private.(crypto.Signer)
+	if !ok {
+		return key, errors.New(path + ".private is not a signing key")
+	}
+	return signingKey{dnskey, signer}, nil
+}
+
+func generateKey(path string, zone string, flags uint16) (key signingKey, err error) {
+	dnskey := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: dnskeyTtl},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	private, err := dnskey.Generate(256)
+	if err != nil {
+		return key, err
+	}
+	if err := os.WriteFile(path+".private", []byte(dnskey.PrivateKeyString(private)), 0600); err != nil {
+		return key, err
+	}
+	if err := os.WriteFile(path+".key", []byte(dnskey.String()+"\n"), 0644); err != nil {
+		return key, err
+	}
+	log.Println("Generated new key", path+".key")
+	return signingKey{dnskey, private.(crypto.Signer)}, nil
+}
+
+// Returns true if the answer to the request should be signed: the zone has
+// keys and the client set the DO bit.
+func (s *DNSServer) isSigning(r *dns.Msg) bool {
+	opt := r.IsEdns0()
+	return s.keys != nil && opt != nil && opt.Do()
+}
+
+func (s *DNSServer) createDNSKEY() []dns.RR {
+	return []dns.RR{dns.Copy(s.keys.ksk.dnskey), dns.Copy(s.keys.zsk.dnskey)}
+}
+
+// Drops the cached signatures after the zone changed.
+func (s *DNSServer) clearSignatures() {
+	if s.keys == nil {
+		return
+	}
+	defer s.keys.lock.Unlock()
+	s.keys.lock.Lock()
+
+	s.keys.signatures = make(map[string]*dns.RRSIG)
+}
+
+// Adds the denial of existence to negative answer and signs all the RRsets
+// of the message which belong to our zone.
+func (s *DNSServer) signMsg(m *dns.Msg, query string, qname string) {
+	if len(m.Answer) == 0 && s.isInZone(qname) {
+		if m.Rcode == dns.RcodeNameError {
+			m.Ns = append(m.Ns, s.createNXDomainNSEC(qname)...)
+		} else {
+			m.Ns = append(m.Ns, s.createNoDataNSEC(query, qname))
+		}
+	}
+
+	m.Answer = s.signRecords(m.Answer)
+	m.Ns = s.signRecords(m.Ns)
+	m.Extra = s.signRecords(m.Extra)
+}
+
+// Returns the records with RRSIG after every RRset in our zone.
+func (s *DNSServer) signRecords(records []dns.RR) (out []dns.RR) {
+	type rrsetKey struct {
+		name   string
+		rrtype uint16
+	}
+	var keys []rrsetKey
+	rrsets := make(map[rrsetKey][]dns.RR)
+	for _, rr := range records {
+		hdr := rr.Header()
+		if hdr.Rrtype == dns.TypeOPT || hdr.Rrtype == dns.TypeRRSIG {
+			out = append(out, rr)
+			continue
+		}
+		key := rrsetKey{hdr.Name, hdr.Rrtype}
+		if _, ok := rrsets[key]; !ok {
+			keys = append(keys, key)
+		}
+		rrsets[key] = append(rrsets[key], rr)
+	}
+
+	for _, key := range keys {
+		rrset := rrsets[key]
+		out = append(out, rrset...)
+		if !s.isInZone(key.name) {
+			continue
+		}
+		if rrsig, err := s.getSignature(rrset); err != nil {
+			log.Println("Can't sign", key.name, dns.TypeToString[key.rrtype], err)
+		} else {
+			out = append(out, rrsig)
+		}
+	}
+	return
+}
+
+// Returns the signature of the RRset, from the cache if it's there and fresh.
+func (s *DNSServer) getSignature(rrset []dns.RR) (*dns.RRSIG, error) {
+	lines := make([]string, len(rrset))
+	for i, rr := range rrset {
+		lines[i] = strings.ToLower(rr.String())
+	}
+	sort.Strings(lines)
+	key := strings.Join(lines, "\n")
+
+	now := time.Now()
+	s.keys.lock.Lock()
+	rrsig, ok := s.keys.signatures[key]
+	s.keys.lock.Unlock()
+
+	if !ok || time.Unix(int64(rrsig.Expiration), 0).Sub(now) < signatureValidity/2 {
+		k := s.keys.zsk
+		if rrset[0].Header().Rrtype == dns.TypeDNSKEY {
+			k = s.keys.ksk
+		}
+		rrsig = &dns.RRSIG{
+			Hdr:        dns.RR_Header{Ttl: rrset[0].Header().Ttl},
+			Algorithm:  k.dnskey.Algorithm,
+			KeyTag:     k.dnskey.KeyTag(),
+			SignerName: k.dnskey.Hdr.Name,
+			Inception:  uint32(now.Add(-signatureSkew).Unix()),
+			Expiration: uint32(now.Add(signatureValidity).Unix()),
+		}
+		if err := rrsig.Sign(k.signer, rrset); err != nil {
+			return nil, err
+		}
+
+		s.keys.lock.Lock()
+		if len(s.keys.signatures) >= maxSignatures {
+			s.keys.signatures = make(map[string]*dns.RRSIG)
+		}
+		s.keys.signatures[key] = rrsig
+		s.keys.lock.Unlock()
+	}
+
+	// The owner name is signed lowercase, the answer has it as the client
+	// asked.
+	rrsig = dns.Copy(rrsig).(*dns.RRSIG)
+	rrsig.Hdr.Name = rrset[0].Header().Name
+	return rrsig, nil
+}
+
+func (s *DNSServer) createNSEC(name string, next string, types []uint16) *dns.NSEC {
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: uint32(s.config.ttl)},
+		NextDomain: next,
+		TypeBitMap: types,
+	}
+}
+
+// Returns NSEC records proving that the name and the wildcard which could
+// have matched it don't exist. The records are minimally covering "white
+// lies" (RFC 4470): they cover just the name, so they don't reveal the other
+// names of the zone.
+func (s *DNSServer) createNXDomainNSEC(qname string) []dns.RR {
+	name := strings.ToLower(qname)
+	records := []dns.RR{s.createNSEC(predecessor(name), `\000.`+name, []uint16{dns.TypeRRSIG, dns.TypeNSEC})}
+
+	// The NSEC above makes the parent the closest encloser.
+	if i := strings.Index(name, "."); i != -1 && name[i+1:] != "" {
+		wildcard := "*." + name[i+1:]
+		if wildcard != name {
+			records = append(records, s.createNSEC(predecessor(wildcard), `\000.`+wildcard, []uint16{dns.TypeRRSIG, dns.TypeNSEC}))
+		}
+	}
+	return records
+}
+
+// Returns NSEC record of the existing name which lists the types the name has.
+func (s *DNSServer) createNoDataNSEC(query string, qname string) dns.RR {
+	types := []uint16{dns.TypeRRSIG, dns.TypeNSEC}
+	for _, qtype := range anyTypes {
+		a := s.lookup(query, qtype, qname, maxCnameChain, false)
+		if len(a.Answer) > 0 && a.Answer[0].Header().Rrtype == qtype {
+			types = append(types, qtype)
+		}
+	}
+	return s.createNSEC(qname, `\000.`+strings.ToLower(qname), types)
+}
+
+// Returns a name right before the name in canonical order (RFC 4034 6.1):
+// the last octet of the first label is decremented and followed by the
+// highest octet, e.g. "fo\110\255.docker." ("fon\255") for "foo.docker.".
+func predecessor(name string) string {
+	i := strings.Index(name, ".")
+	label, rest := name[:i], name[i:]
+	if label == "" || strings.Contains(label, `\`) {
+		// Escaped labels are rare enough, the parent is before any name
+		// under it.
+		return strings.TrimPrefix(rest, ".")
+	}
+	out := label[:len(label)-1] + fmt.Sprintf(`\%03d`, label[len(label)-1]-1)
+	if len(label) < 63 {
+		out += `\255`
+	}
+	return out + rest
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestPredecessor(t *testing.T) {
+	inputs := map[string]string{
+		"foo.docker.":     `fo\110\255.docker.`,
+		"a.b.docker.":     `\096\255.b.docker.`,
+		"*.docker.":       `\041\255.docker.`,
+		"web1.docker.":    `web\048\255.docker.`,
+		`\000.docker.`:    "docker.",
+		"x.preview.local": `\119\255.preview.local`,
+	}
+	for name, expected := range inputs {
+		if actual := predecessor(name); actual != expected {
+			t.Error(name, "Expected:", expected, "Got:", actual)
+		}
+		if actual := predecessor(name); !canonicalLess(actual, name) {
+			t.Error(name, "Predecessor", actual, "doesn't sort before the name")
+		}
+	}
+}
+
+func TestLoadKeys(t *testing.T) {
+	dir, err := os.MkdirTemp("", "dnscock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewDNSServer(NewConfig())
+	if err := s.LoadKeys(dir); err != nil {
+		t.Fatal("Generating keys failed", err)
+	}
+	if s.keys.ksk.dnskey.Flags != 257 || s.keys.zsk.dnskey.Flags != 256 {
+		t.Error("Wrong key flags", s.keys.ksk.dnskey, s.keys.zsk.dnskey)
+	}
+
+	loaded := NewDNSServer(NewConfig())
+	if err := loaded.LoadKeys(dir); err != nil {
+		t.Fatal("Loading keys failed", err)
+	}
+	if loaded.keys.ksk.dnskey.KeyTag() != s.keys.ksk.dnskey.KeyTag() || loaded.keys.zsk.dnskey.KeyTag() != s.keys.zsk.dnskey.KeyTag() {
+		t.Error("Loaded keys differ from the generated ones")
+	}
+
+	config := NewConfig()
+	config.domain = NewDomain("other")
+	if err := NewDNSServer(config).LoadKeys(dir); err != nil {
+		t.Error("Keys of other zone should be generated next to them", err)
+	}
+
+	// Secondaries would serve the zone unsigned
+	config = NewConfig()
+	config.allowTransfer, _ = ParseNetworks("10.0.0.0/8")
+	if err := NewDNSServer(config).LoadKeys(dir); err == nil {
+		t.Error("Signing should be refused with -allow-transfer")
+	}
+	config = NewConfig()
+	config.notify = []string{"10.0.0.2:53"}
+	if err := NewDNSServer(config).LoadKeys(dir); err == nil {
+		t.Error("Signing should be refused with -notify")
+	}
+}
+
+// Checks that every RRset of the section is signed by the key.
+func verifySection(t *testing.T, name string, section []dns.RR, key *dns.DNSKEY) {
+	rrsets := make(map[uint16][]dns.RR)
+	sigs := make(map[uint16][]*dns.RRSIG)
+	for _, rr := range section {
+		if rrsig, ok := rr.(*dns.RRSIG); ok {
+			sigs[rrsig.TypeCovered] = append(sigs[rrsig.TypeCovered], rrsig)
+		} else {
+			rrsets[rr.Header().Rrtype] = append(rrsets[rr.Header().Rrtype], rr)
+		}
+	}
+	for rrtype, rrset := range rrsets {
+		if rrtype == dns.TypeNSEC {
+			// More NSEC RRsets, verify them one by one
+			for i, rr := range rrset {
+				if i >= len(sigs[rrtype]) || sigs[rrtype][i].Verify(key, []dns.RR{rr}) != nil {
+					t.Error(name, "NSEC", rr, "is not signed")
+				}
+			}
+			continue
+		}
+		if len(sigs[rrtype]) != 1 {
+			t.Error(name, dns.TypeToString[rrtype], "Expected: 1 RRSIG Got:", len(sigs[rrtype]))
+			continue
+		}
+		if err := sigs[rrtype][0].Verify(key, rrset); err != nil {
+			t.Error(name, dns.TypeToString[rrtype], "Signature doesn't verify", err)
+		}
+		if !sigs[rrtype][0].ValidityPeriod(time.Now()) {
+			t.Error(name, dns.TypeToString[rrtype], "Signature is not valid now")
+		}
+	}
+}
+
+func TestSignedAnswers(t *testing.T) {
+	const TEST_ADDR = "127.0.0.1:9964"
+
+	dir, err := os.MkdirTemp("", "dnscock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := NewConfig()
+	config.dnsAddr = TEST_ADDR
+	server := NewDNSServer(config)
+	if err := server.LoadKeys(dir); err != nil {
+		t.Fatal(err)
+	}
+	go server.Start()
+
+	// Allow some time for server to start
+	time.Sleep(250 * time.Millisecond)
+
+	server.AddService("web1", Service{Name: "web", Image: "myapp", Ip: net.ParseIP("172.17.0.2"), Ttl: -1})
+	ksk, zsk := server.keys.ksk.dnskey, server.keys.zsk.dnskey
+
+	exchange := func(qname string, qtype uint16, do bool) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(qname, qtype)
+		m.SetEdns0(4096, do)
+		in, _, err := new(dns.Client).Exchange(m, TEST_ADDR)
+		if err != nil {
+			t.Fatal(qname, "Error response from the server", err)
+		}
+		return in
+	}
+
+	in := exchange("Web.MyApp.docker.", dns.TypeA, true)
+	if len(in.Answer) != 2 || !in.IsEdns0().Do() {
+		t.Error("Expected A with RRSIG and DO bit, Got:", in)
+	}
+	verifySection(t, "A", in.Answer, zsk)
+
+	// Signature is cached, until the zone changes
+	first := exchange("web.myapp.docker.", dns.TypeA, true).Answer[1].(*dns.RRSIG)
+	if second := exchange("web.myapp.docker.", dns.TypeA, true).Answer[1].(*dns.RRSIG); first.Signature != second.Signature {
+		t.Error("Signature should be cached")
+	}
+	server.AddService("web2", Service{Name: "web2", Image: "myapp", Ip: net.ParseIP("172.17.0.3"), Ttl: -1})
+	if third := exchange("web.myapp.docker.", dns.TypeA, true).Answer[1].(*dns.RRSIG); first.Signature == third.Signature {
+		t.Error("Signature cache should be dropped when the zone changes")
+	}
+
+	in = exchange("docker.", dns.TypeDNSKEY, true)
+	if len(in.Answer) != 3 {
+		t.Error("Expected 2 DNSKEY and RRSIG, Got:", in.Answer)
+	}
+	verifySection(t, "DNSKEY", in.Answer, ksk)
+
+	in = exchange("nothing.docker.", dns.TypeA, true)
+	if in.Rcode != dns.RcodeNameError {
+		t.Error("Expected NXDOMAIN Got:", dns.RcodeToString[in.Rcode])
+	}
+	nsecs := 0
+	for _, rr := range in.Ns {
+		if nsec, ok := rr.(*dns.NSEC); ok {
+			nsecs++
+			if covers(nsec, "nothing.docker.") || covers(nsec, "*.docker.") {
+				continue
+			}
+			t.Error("NSEC", nsec, "covers neither the name nor the wildcard")
+		}
+	}
+	if nsecs != 2 {
+		t.Error("Expected: 2 NSEC Got:", in.Ns)
+	}
+	verifySection(t, "NXDOMAIN", in.Ns, zsk)
+
+	in = exchange("web.myapp.docker.", dns.TypeMX, true)
+	if in.Rcode != dns.RcodeSuccess || len(in.Answer) != 0 {
+		t.Error("Expected NODATA Got:", in)
+	}
+	for _, rr := range in.Ns {
+		if nsec, ok := rr.(*dns.NSEC); ok {
+			if nsec.Hdr.Name != "web.myapp.docker." || !containsType(nsec.TypeBitMap, dns.TypeA) || containsType(nsec.TypeBitMap, dns.TypeMX) {
+				t.Error("Wrong NODATA NSEC", nsec)
+			}
+		}
+	}
+	verifySection(t, "NODATA", in.Ns, zsk)
+
+	in = exchange("web.myapp.docker.", dns.TypeA, false)
+	if len(in.Answer) != 1 || in.IsEdns0().Do() {
+		t.Error("Answer without DO should not be signed", in)
+	}
+}
+
+func containsType(types []uint16, rrtype uint16) bool {
+	for _, t := range types {
+		if t == rrtype {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the labels of the name in canonical order (RFC 4034 6.1), from the
+// root.
+func canonicalLabels(name string) (labels [][]byte) {
+	buf := make([]byte, 256)
+	n, _ := dns.PackDomainName(dns.CanonicalName(name), buf, 0, nil, false)
+	for i := 0; i < n && buf[i] != 0; i += int(buf[i]) + 1 {
+		labels = append([][]byte{buf[i+1 : i+1+int(buf[i])]}, labels...)
+	}
+	return
+}
+
+func canonicalLess(a, b string) bool {
+	la, lb := canonicalLabels(a), canonicalLabels(b)
+	for i := 0; i < len(la) && i < len(lb); i++ {
+		if c := bytes.Compare(la[i], lb[i]); c != 0 {
+			return c < 0
+		}
+	}
+	return len(la) < len(lb)
+}
+
+func covers(nsec *dns.NSEC, name string) bool {
+	return canonicalLess(nsec.Hdr.Name, name) && canonicalLess(name, nsec.NextDomain)
+}
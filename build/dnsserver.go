@@ -5,19 +5,51 @@ import (
 	"log"
 	"net"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
 )
 
 type Service struct {
-	Name  string
-	Image string
-	Ip    net.IP
-	Ttl   int
-	Alias string
+	Name    string
+	Image   string
+	Ip      net.IP
+	Ipv6    net.IP
+	Ttl     int
+	Weight  int
+	Health  string
+	Alias   string
+	Cname   string
+	Ports   []ServicePort
+	Meta    ServiceMeta
+	Records []dns.RR
+
+	// Answer even when the healthcheck of the container fails.
+	IgnoreHealth bool
+}
+
+// ServiceMeta is the metadata of the container published in TXT records.
+// NameSource tells where the name of the service came from, e.g. DNSDOCK_NAME.
+type ServiceMeta struct {
+	Id         string
+	Image      string
+	Created    string
+	Started    string
+	NameSource string
+	Labels     map[string]string
+}
+
+// ServicePort is a port exposed by the container. Name is the service name
+// used in SRV queries, it's empty if not known.
+type ServicePort struct {
+	Name     string
+	Port     uint16
+	Protocol string
 }
 
 func NewService() (s *Service) {
@@ -29,15 +61,36 @@ type ServiceListProvider interface {
 	AddService(string, Service)
 	RemoveService(string) error
 	GetService(string) (Service, error)
+	SetHealth(string, string) error
 	GetAllServices() map[string]Service
 }
 
 type DNSServer struct {
 	config   *Config
-	server   *dns.Server
+	servers  []*dns.Server
 	services map[string]*Service
 	aliases  map[string]map[string]struct{}
+	cnames   map[string]map[string]string
+	reverse  map[string]map[string]struct{}
+	dynamic  map[string][]dns.RR
+	serial   uint32
 	lock     *sync.RWMutex
+
+	journal []journalEntry
+
+	keys *zoneKeys
+
+	upstreams          *upstreams
+	rules              []*forwardRule
+	cache              *responseCache
+	resolvConfInterval time.Duration
+
+	rotations    map[string]uint64
+	rotationLock sync.Mutex
+
+	notifyCh    chan struct{}
+	notifyDelay time.Duration
+	done        chan struct{}
 }
 
 func NewDNSServer(c *Config) *DNSServer {
@@ -45,30 +98,105 @@ func NewDNSServer(c *Config) *DNSServer {
 		config:   c,
 		services: make(map[string]*Service),
 		aliases:  make(map[string]map[string]struct{}),
+		cnames:   make(map[string]map[string]string),
+		reverse:  make(map[string]map[string]struct{}),
+		dynamic:  make(map[string][]dns.RR),
 		lock:     &sync.RWMutex{},
+
+		rotations: make(map[string]uint64),
+
+		resolvConfInterval: resolvConfInterval,
+
+		notifyCh:    make(chan struct{}, 1),
+		notifyDelay: notifyDelay,
+		done:        make(chan struct{}),
+	}
+	// Start from the current time so that the serial doesn't go backwards
+	// when dnscock is restarted.
+	s.serial = uint32(time.Now().Unix())
+	s.upstreams = newUpstreams(s.filterOwnAddresses(c.nameservers), c.forwardStrategy)
+	s.createForwardRules(c.forwardRules)
+	if c.cacheSize > 0 {
+		s.cache = newResponseCache(c.cacheSize)
 	}
 
-	mux := dns.NewServeMux()
-	//mux.HandleFunc(c.domain[len(c.domain)-1]+".", s.handleRequest)
-	//mux.HandleFunc(".", s.forwardRequest)
-	mux.HandleFunc(".", s.handleRequest)
+	// No ServeMux, it would refuse messages without question before
+	// handleRequest gets to check them.
+	handler := dns.HandlerFunc(s.handleRequest)
 
-	s.server = &dns.Server{Addr: c.dnsAddr, Net: "udp", Handler: mux}
+	// UDP and TCP listeners share the address and the handler. Clients which
+	// get a truncated UDP answer retry over TCP.
+	s.servers = []*dns.Server{
+		&dns.Server{Addr: c.dnsAddr, Net: "udp", Handler: handler, TsigSecret: c.tsigKeys, MsgAcceptFunc: acceptMsg},
+		&dns.Server{Addr: c.dnsAddr, Net: "tcp", Handler: handler, TsigSecret: c.tsigKeys, MsgAcceptFunc: acceptMsg},
+	}
 
 	return s
 }
 
 func (s *DNSServer) IsLocal(name string) bool {
 	// Is it really this easy? I haven't read the RFCs.
-	return strings.HasSuffix(name, s.config.domain.String())
+	return strings.HasSuffix(strings.ToLower(name), s.config.domain.String())
 }
 
+// Start runs all the listeners and blocks until one of them fails.
 func (s *DNSServer) Start() error {
-	return s.server.ListenAndServe()
+	if len(s.config.notify) > 0 {
+		go s.runNotifier(s.done)
+	}
+	if s.config.resolvConf != "" {
+		content, err := s.loadResolvConf(s.config.resolvConf)
+		if err != nil {
+			log.Println("Can't read", s.config.resolvConf+":", err)
+		}
+		go s.watchResolvConf(s.config.resolvConf, content, s.done)
+	}
+
+	errs := make(chan error, len(s.servers))
+	for _, server := range s.servers {
+		go func(server *dns.Server) {
+			errs <- server.ListenAndServe()
+		}(server)
+	}
+	return <-errs
 }
 
 func (s *DNSServer) Stop() {
-	s.server.Shutdown()
+	close(s.done)
+	for _, server := range s.servers {
+		server.Shutdown()
+	}
+}
+
+// writeMsg sends the reply m to the request r. Replies over UDP are cut to
+// the size the client can receive and get the TC bit if they don't fit, so
+// that the client retries over TCP.
+func (s *DNSServer) writeMsg(w dns.ResponseWriter, r *dns.Msg, m *dns.Msg) {
+	if _, isUDP := w.RemoteAddr().(*net.UDPAddr); isUDP {
+		m.Truncate(s.getUDPSize(r))
+	}
+	w.WriteMsg(m)
+}
+
+// Returns the size of UDP reply the client can receive: 512 bytes, or the
+// buffer size advertised in EDNS0, capped by the configured maximum.
+func (s *DNSServer) getUDPSize(r *dns.Msg) int {
+	size := dns.MinMsgSize
+	if opt := r.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+		if s.config.maxUDPSize >= dns.MinMsgSize && size > s.config.maxUDPSize {
+			size = s.config.maxUDPSize
+		}
+	}
+	return size
+}
+
+// Adds OPT record to the reply if the request has one (RFC 6891), with our
+// UDP buffer size. The DO bit is echoed when the zone is signed.
+func (s *DNSServer) setEdns(r *dns.Msg, m *dns.Msg) {
+	if r.IsEdns0() != nil && m.IsEdns0() == nil {
+		m.SetEdns0(uint16(s.getUDPSize(r)), s.isSigning(r))
+	}
 }
 
 // This is copypasted from golang/src/net. Once they export it, I can remove
@@ -121,8 +249,17 @@ func isDomainName(s string) bool {
 	return ok
 }
 
+// Wildcard alias "*.suffix" stands for any name under the suffix, but not for
+// the suffix itself.
+func isWildcardAlias(alias string) bool {
+	return strings.HasPrefix(alias, "*.")
+}
+
 func (s *DNSServer) AddAlias(alias string, id string) {
-	ok := isDomainName(alias)
+	// Aliases are stored lowercase, names are matched case-insensitively
+	// (RFC 4343).
+	alias = strings.ToLower(alias)
+	ok := isDomainName(alias) || (isWildcardAlias(alias) && isDomainName(alias[2:]))
 	if ok {
 		// assign service id to alias. If there's no map for the alias key,
 		// create it
@@ -145,6 +282,12 @@ func (s *DNSServer) AddService(id string, service Service) {
 	s.lock.Lock()
 
 	id = s.getExpandedId(id)
+	before := s.getJournalSnapshot()
+	if _, exists := s.services[id]; exists {
+		// restarted container may come back with different addresses
+		s.RemoveReverseForId(id)
+		s.RemoveCnamesForId(id)
+	}
 	s.services[id] = &service
 
 	if service.Alias != "" {
@@ -153,6 +296,20 @@ func (s *DNSServer) AddService(id string, service Service) {
 		}
 	}
 
+	if service.Cname != "" {
+		for _, cname := range strings.Split(service.Cname, ",") {
+			s.AddCname(cname, id)
+		}
+	}
+
+	for _, ip := range []net.IP{service.Ip, service.Ipv6} {
+		if ip != nil {
+			s.AddReverse(ip, id)
+		}
+	}
+
+	s.commitChange(before)
+
 	if s.config.verbose {
 		log.Println("Added service:", id, service)
 	}
@@ -175,6 +332,72 @@ func (s *DNSServer) RemoveAliasesForId(id string) error {
 	return nil
 }
 
+// AddCname registers a CNAME alias declared by the container. The entry is
+// either "name", pointing to the canonical name of the container, or
+// "name:target". Caller must hold the lock.
+func (s *DNSServer) AddCname(entry string, id string) {
+	parts := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+	name := strings.ToLower(strings.TrimSuffix(parts[0], "."))
+	target := s.getCanonicalName(s.services[id])
+	if len(parts) == 2 {
+		target = dns.Fqdn(strings.TrimSpace(parts[1]))
+	}
+	if !isDomainName(name) || !isDomainName(strings.TrimSuffix(target, ".")) {
+		log.Println(entry, "passed as a CNAME is not valid. Not using it.")
+		return
+	}
+	if strings.EqualFold(dns.Fqdn(name), target) {
+		log.Println(entry, "passed as a CNAME points to itself. Not using it.")
+		return
+	}
+	if s.hasOtherData(name) {
+		log.Println(entry, "passed as a CNAME has other records. Not using it.")
+		return
+	}
+	id_map, ok := s.cnames[name]
+	if !ok {
+		id_map = make(map[string]string)
+		s.cnames[name] = id_map
+	}
+	id_map[id] = target
+	log.Println("Added CNAME", name, "->", target, "for id", id)
+}
+
+func (s *DNSServer) RemoveCnamesForId(id string) {
+	for name, id_map := range s.cnames {
+		delete(id_map, id)
+		if len(id_map) == 0 {
+			delete(s.cnames, name)
+		}
+	}
+}
+
+// AddReverse registers the service id under the in-addr.arpa or ip6.arpa name
+// of the ip, so that PTR queries for the container IPs can be answered.
+func (s *DNSServer) AddReverse(ip net.IP, id string) {
+	name, err := dns.ReverseAddr(ip.String())
+	if err != nil {
+		log.Println("Can't create reverse name for", ip, err)
+		return
+	}
+	name = strings.TrimSuffix(name, ".")
+	id_map, ok := s.reverse[name]
+	if !ok {
+		id_map = make(map[string]struct{})
+		s.reverse[name] = id_map
+	}
+	id_map[id] = struct{}{}
+}
+
+func (s *DNSServer) RemoveReverseForId(id string) {
+	for name, id_map := range s.reverse {
+		delete(id_map, id)
+		if len(id_map) == 0 {
+			delete(s.reverse, name)
+		}
+	}
+}
+
 func (s *DNSServer) RemoveService(id string) error {
 	defer s.lock.Unlock()
 	s.lock.Lock()
@@ -184,10 +407,15 @@ func (s *DNSServer) RemoveService(id string) error {
 		return errors.New("No such service: " + id)
 	}
 
+	before := s.getJournalSnapshot()
 	s.RemoveAliasesForId(id)
+	s.RemoveCnamesForId(id)
+	s.RemoveReverseForId(id)
 
 	delete(s.services, id)
 
+	s.commitChange(before)
+
 	if s.config.verbose {
 		log.Println("Stopped service:", id)
 	}
@@ -208,6 +436,22 @@ func (s *DNSServer) GetService(id string) (Service, error) {
 	}
 }
 
+// Updates the health of the service. Health only picks which records are
+// answered, the zone stays the same, so the serial is not bumped and
+// secondaries are not notified.
+func (s *DNSServer) SetHealth(id string, health string) error {
+	defer s.lock.Unlock()
+	s.lock.Lock()
+
+	id = s.getExpandedId(id)
+	service, ok := s.services[id]
+	if !ok {
+		return errors.New("No such service: " + id)
+	}
+	service.Health = health
+	return nil
+}
+
 func (s *DNSServer) GetAllServices() map[string]Service {
 	defer s.lock.RUnlock()
 	s.lock.RLock()
@@ -220,43 +464,287 @@ func (s *DNSServer) GetAllServices() map[string]Service {
 	return list
 }
 
+// The request is forwarded as is, so its EDNS0 options (e.g. the DO bit)
+// reach the nameserver and DNSSEC records in the answer are passed back. When
+// none of the nameservers answers, the client gets SERVFAIL.
 func (s *DNSServer) forwardRequest(w dns.ResponseWriter, r *dns.Msg) {
-	c := new(dns.Client)
-	if in, _, err := c.Exchange(r, s.config.nameserver); err != nil {
-		log.Print(err)
-		w.WriteMsg(new(dns.Msg))
-	} else {
-		w.WriteMsg(in)
+	network := "udp"
+	if _, isTCP := w.RemoteAddr().(*net.TCPAddr); isTCP {
+		network = "tcp"
+	}
+	in, err := s.exchange(r, network)
+	if err == nil && in.Rcode == dns.RcodeNameError && s.config.search {
+		if found := s.searchRequest(r, network); found != nil {
+			in = found
+		}
+	}
+	if err != nil {
+		log.Println("Can't forward", r.Question[0].Name+":", err)
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeServerFailure)
+		s.setEdns(r, m)
+		s.writeMsg(w, r, m)
+		return
 	}
+	s.writeMsg(w, r, in)
 }
 
-func getServiceRecord(s *Service, name string, default_ttl int) *dns.A {
-	rr := new(dns.A)
-	var ttl int
+func getServiceTtl(s *Service, default_ttl int) uint32 {
 	if s.Ttl != -1 {
-		ttl = s.Ttl
-	} else {
-		ttl = default_ttl
+		return uint32(s.Ttl)
 	}
-	rr.Hdr = dns.RR_Header{
+	return uint32(default_ttl)
+}
+
+// Returns A or AAAA record for the service, depending on qtype. If the service
+// doesn't have an address of the requested family, nil is returned.
+func getServiceRecord(s *Service, name string, qtype uint16, default_ttl int) dns.RR {
+	hdr := dns.RR_Header{
 		Name:   name,
-		Rrtype: dns.TypeA,
+		Rrtype: qtype,
 		Class:  dns.ClassINET,
-		Ttl:    uint32(ttl),
+		Ttl:    getServiceTtl(s, default_ttl),
 	}
-	rr.A = s.Ip
-	return rr
+	switch qtype {
+	case dns.TypeA:
+		if ip := s.Ip.To4(); ip != nil {
+			return &dns.A{Hdr: hdr, A: ip}
+		}
+	case dns.TypeAAAA:
+		if s.Ipv6 != nil && s.Ipv6.To4() == nil {
+			return &dns.AAAA{Hdr: hdr, AAAA: s.Ipv6}
+		}
+	}
+	return nil
 }
 
-func (s *DNSServer) getServicesForAlias(alias string) (pointed []*Service) {
+func isAddressQuery(qtype uint16) bool {
+	return qtype == dns.TypeA || qtype == dns.TypeAAAA
+}
 
+// Canonical name of the service, <name>.<image>.<environment>.<domain>. The
+// image part is left out for containers which are not started from a tag.
+func canonicalName(service *Service, domain Domain) string {
+	parts := []string{service.Name}
+	if service.Image != "" {
+		parts = append(parts, service.Image)
+	}
+	parts = append(parts, domain.String())
+	return dns.Fqdn(strings.Join(parts, "."))
+}
+
+func (s *DNSServer) getCanonicalName(service *Service) string {
+	return canonicalName(service, s.config.domain)
+}
+
+// Returns PTR records for reverse name of a container IP: the canonical names
+// of the containers and their aliases. Returns nil for unknown addresses.
+func (s *DNSServer) getReverseRecords(name string, qname string) []dns.RR {
 	defer s.lock.RUnlock()
 	s.lock.RLock()
 
-	for service_id := range s.aliases[alias] {
+	var records []dns.RR
+	for service_id := range s.reverse[name] {
+		service := s.services[service_id]
+		targets := []string{s.getCanonicalName(service)}
+		if service.Alias != "" {
+			for _, alias := range strings.Split(service.Alias, ",") {
+				alias = strings.ToLower(alias)
+				if _, ok := s.aliases[alias]; ok && !isWildcardAlias(alias) {
+					targets = append(targets, dns.Fqdn(alias))
+				}
+			}
+		}
+		for _, target := range targets {
+			records = append(records, &dns.PTR{
+				Hdr: dns.RR_Header{
+					Name:   qname,
+					Rrtype: dns.TypePTR,
+					Class:  dns.ClassINET,
+					Ttl:    getServiceTtl(service, s.config.ttl),
+				},
+				Ptr: target,
+			})
+		}
+	}
+	return records
+}
+
+// Returns SRV records for queries like _http._tcp.web.myapp.docker, with the
+// A and AAAA records of the targets for the additional section. The service
+// label can also be the port number, e.g. _8080._tcp. matched is false if the
+// name doesn't match any container.
+func (s *DNSServer) getSRVRecords(query string, qname string) (answer []dns.RR, extra []dns.RR, matched bool) {
+	labels := strings.SplitN(strings.ToLower(query), ".", 3)
+	if len(labels) != 3 || !strings.HasPrefix(labels[0], "_") || !strings.HasPrefix(labels[1], "_") {
+		return nil, nil, false
+	}
+	name, protocol := labels[0][1:], labels[1][1:]
+
+	for _, service := range filterHealthy(s.getServices(labels[2])) {
+		matched = true
+		target := s.getCanonicalName(service)
+		found := false
+		for _, port := range service.Ports {
+			if port.Protocol != protocol {
+				continue
+			}
+			if name != strings.ToLower(port.Name) && name != strconv.Itoa(int(port.Port)) {
+				continue
+			}
+			found = true
+			answer = append(answer, s.getSRVRecord(service, port, qname))
+		}
+		if found {
+			for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+				if rr := getServiceRecord(service, target, qtype, s.config.ttl); rr != nil {
+					extra = append(extra, rr)
+				}
+			}
+		}
+	}
+	return
+}
+
+// Maximum length of a TXT character-string.
+const maxTxtString = 255
+
+// Returns TXT record with the container metadata, in key=value strings.
+// Strings longer than 255 bytes are split into more strings, the way long
+// SPF and DKIM records are.
+func (s *DNSServer) getTXTRecord(service *Service, name string) *dns.TXT {
+	meta := service.Meta
+	var txt []string
+	for _, kv := range []string{
+		"id=" + meta.Id,
+		"image=" + meta.Image,
+		"created=" + meta.Created,
+		"started=" + meta.Started,
+		"name-source=" + meta.NameSource,
+	} {
+		txt = append(txt, splitTxt(kv)...)
+	}
+	labels := make([]string, 0, len(meta.Labels))
+	for label := range meta.Labels {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		txt = append(txt, splitTxt("label:"+label+"="+meta.Labels[label])...)
+	}
+	return &dns.TXT{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeTXT,
+			Class:  dns.ClassINET,
+			Ttl:    getServiceTtl(service, s.config.ttl),
+		},
+		Txt: txt,
+	}
+}
+
+// Splits the string into character-strings of at most 255 bytes.
+func splitTxt(s string) []string {
+	var out []string
+	for len(s) > maxTxtString {
+		out = append(out, s[:maxTxtString])
+		s = s[maxTxtString:]
+	}
+	return append(out, s)
+}
+
+func (s *DNSServer) getSRVRecord(service *Service, port ServicePort, name string) *dns.SRV {
+	return &dns.SRV{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeSRV,
+			Class:  dns.ClassINET,
+			Ttl:    getServiceTtl(service, s.config.ttl),
+		},
+		Priority: 0,
+		Weight:   0,
+		Port:     port.Port,
+		Target:   s.getCanonicalName(service),
+	}
+}
+
+func (s *DNSServer) getServicesForAlias(alias string) (pointed []*Service, exists bool) {
+
+	defer s.lock.RUnlock()
+	s.lock.RLock()
+
+	alias = strings.ToLower(alias)
+	id_map, exists := s.aliases[alias]
+	if !exists {
+		id_map, exists = s.aliases[s.matchWildcardAlias(alias)]
+	}
+	for service_id := range id_map {
 		pointed = append(pointed, s.services[service_id])
 	}
-	return pointed
+	return pointed, exists
+}
+
+// Returns the most specific wildcard alias matching the name, e.g.
+// "*.b.preview.local" before "*.preview.local" for "a.b.preview.local", or
+// empty string. Caller must hold the lock.
+func (s *DNSServer) matchWildcardAlias(name string) string {
+	labels := strings.Split(name, ".")
+	for i := 1; i < len(labels); i++ {
+		wildcard := "*." + strings.Join(labels[i:], ".")
+		if _, ok := s.aliases[wildcard]; ok {
+			return wildcard
+		}
+	}
+	return ""
+}
+
+// Returns the CNAME record for a CNAME alias declared by containers, or nil.
+// If more containers declare the same name, the one with the lowest id wins
+// so that the answer is stable.
+func (s *DNSServer) getCname(name string, qname string) *dns.CNAME {
+	defer s.lock.RUnlock()
+	s.lock.RLock()
+
+	return s.createCname(strings.ToLower(name), qname)
+}
+
+// Returns the CNAME of the name, unless a container added later has records
+// at the name. Caller must hold the lock.
+func (s *DNSServer) createCname(name string, qname string) *dns.CNAME {
+	id_map, ok := s.cnames[name]
+	if !ok || s.hasOtherData(name) {
+		return nil
+	}
+	var id string
+	for service_id := range id_map {
+		if id == "" || service_id < id {
+			id = service_id
+		}
+	}
+	return &dns.CNAME{
+		Hdr: dns.RR_Header{
+			Name:   qname,
+			Rrtype: dns.TypeCNAME,
+			Class:  dns.ClassINET,
+			Ttl:    getServiceTtl(s.services[id], s.config.ttl),
+		},
+		Target: id_map[id],
+	}
+}
+
+// Maximum number of CNAMEs followed when resolving from local data.
+const maxCnameChain = 8
+
+// localAnswer is the result of resolving a name from the local data. Exists is
+// true if the name exists even though it may not have records of the
+// requested type. Local is true if the name is ours, i.e. it's in our domain,
+// or it's an alias or a reverse name of a container.
+type localAnswer struct {
+	Answer []dns.RR
+	Ns     []dns.RR
+	Extra  []dns.RR
+	Exists bool
+	Local  bool
 }
 
 func (s *DNSServer) handleRequest(w dns.ResponseWriter, r *dns.Msg) {
@@ -267,74 +755,265 @@ func (s *DNSServer) handleRequest(w dns.ResponseWriter, r *dns.Msg) {
 		log.Println("incoming query", r)
 	}
 
-	query := r.Question[0].Name
+	if r.Opcode == dns.OpcodeUpdate {
+		s.handleUpdate(w, r)
+		return
+	}
+
+	if opt := r.IsEdns0(); opt != nil && opt.Version() != 0 {
+		// We speak only EDNS version 0.
+		s.setEdns(r, m)
+		m.Rcode = dns.RcodeBadVers
+		s.writeMsg(w, r, m)
+		return
+	}
 
-	if query[len(query)-1] == '.' {
-		query = query[:len(query)-1]
+	if rcode := s.checkRequest(r); rcode != dns.RcodeSuccess {
+		s.writeError(w, r, rcode)
+		return
 	}
 
+	query := strings.TrimSuffix(r.Question[0].Name, ".")
+
 	if query == "print-status" {
+		s.lock.RLock()
 		log.Println("services: ", s.services)
 		log.Println("aliases: ", s.aliases)
+		var wildcards []string
+		for alias := range s.aliases {
+			if isWildcardAlias(alias) {
+				wildcards = append(wildcards, alias)
+			}
+		}
+		sort.Strings(wildcards)
+		log.Println("wildcard aliases: ", wildcards)
+		log.Println("cnames: ", s.cnames)
+		s.upstreams.logStatus()
+		for _, rule := range s.rules {
+			log.Println("forward rule:", rule.domain)
+			rule.upstreams.logStatus()
+		}
+		if s.cache != nil {
+			s.cache.logStatus()
+		}
+		s.lock.RUnlock()
 	}
 
-	alias_id_map, alias_exists := s.aliases[query]
-	if alias_exists {
-		if r.Question[0].Qtype == dns.TypeA {
+	qtype := r.Question[0].Qtype
+
+	if qtype == dns.TypeAXFR || qtype == dns.TypeIXFR {
+		s.handleTransfer(w, r)
+		return
+	}
+
+	a := s.resolve(query, qtype, r.Question[0].Name, 0)
+	if !a.Local {
+		if s.config.debug {
+			log.Println("query is not local, forwarding")
+		}
+		s.forwardRequest(w, r)
+		return
+	}
+	m.Authoritative = true
+	m.Answer, m.Ns, m.Extra = a.Answer, a.Ns, a.Extra
+	if len(m.Answer) == 0 {
+		s.setNegativeAnswer(m, a.Exists)
+	}
+	if s.isSigning(r) {
+		s.signMsg(m, query, r.Question[0].Name)
+	}
+	s.setEdns(r, m)
+
+	s.writeMsg(w, r, m)
+}
+
+// Resolves the query from the local data. Records in the answer are named
+// qname. depth is the number of CNAMEs followed so far.
+func (s *DNSServer) resolve(query string, qtype uint16, qname string, depth int) localAnswer {
+	return s.lookup(query, qtype, qname, depth, true)
+}
+
+// Resolves the query like resolve. Round-robin state moves on only if rotate
+// is set, lookups which don't end up as the answer (e.g. types for ANY or
+// NSEC) must not make the rotation skip.
+func (s *DNSServer) lookup(query string, qtype uint16, qname string, depth int, rotate bool) (a localAnswer) {
+	if qtype == dns.TypeANY {
+		return s.resolveAny(query, qname)
+	}
+
+	if qtype == dns.TypePTR {
+		if records := s.getReverseRecords(strings.ToLower(query), qname); records != nil {
 			if s.config.debug {
-				log.Println("A query for existing alias, getting all the pointed services for A records in reply")
+				log.Println("PTR query for container IP")
 			}
-			m.Answer = make([]dns.RR, 0, len(alias_id_map))
-			relevant_services := s.getServicesForAlias(query)
+			return localAnswer{Answer: records, Exists: true, Local: true}
+		}
+	}
+
+	if cname := s.getCname(query, qname); cname != nil {
+		if s.config.debug {
+			log.Println("query for CNAME alias")
+		}
+		a = localAnswer{Answer: []dns.RR{cname}, Exists: true, Local: true}
+		return s.chaseCname(a, qtype, depth, rotate)
+	}
 
+	relevant_services, alias_exists := s.getServicesForAlias(query)
+	if alias_exists {
+		a = localAnswer{Exists: true, Local: true}
+		if isAddressQuery(qtype) {
+			if s.config.debug {
+				log.Println("Address query for existing alias, getting all the pointed services for records in reply")
+			}
+			var records []weightedRecord
+			relevant_services = filterHealthy(relevant_services)
 			for i := range relevant_services {
-				m.Answer = append(m.Answer,
-					getServiceRecord(
-						relevant_services[i], r.Question[0].Name, s.config.ttl))
+				rr := getServiceRecord(relevant_services[i], qname, qtype, s.config.ttl)
+				if rr != nil {
+					records = append(records, weightedRecord{rr, getServiceWeight(relevant_services[i])})
+				}
 			}
-			w.WriteMsg(m)
-			return
-		} else {
-			if s.config.debug {
-				log.Println("non-A query for existing alias, return SOA")
+			a.Answer = s.orderRecords(query, qtype, records, rotate)
+		} else if qtype == dns.TypeTXT && s.config.txt {
+			for i := range relevant_services {
+				a.Answer = append(a.Answer, s.getTXTRecord(relevant_services[i], qname))
 			}
-			m.Answer = s.createSOA()
-			w.WriteMsg(m)
-			return
+		} else if s.config.debug {
+			log.Println("non-address query for existing alias, reply with NODATA")
 		}
+		return
 	}
 
 	if !s.IsLocal(query) {
-		if s.config.debug {
-			log.Println("query is not local, forwarding")
-		}
-		s.forwardRequest(w, r)
 		return
 	}
 	if s.config.debug {
 		log.Println("This query is for local domain", s.config.domain)
 	}
 
-	if r.Question[0].Qtype != dns.TypeA {
+	a.Local = true
+
+	apex := strings.EqualFold(query, s.config.domain.String())
+	switch {
+	case apex && qtype == dns.TypeSOA:
+		a.Answer = s.createSOA()
+		a.Ns = s.createNS()
+	case apex && qtype == dns.TypeNS:
+		a.Answer = s.createNS()
+		a.Extra = append(s.createGlue(dns.TypeA), s.createGlue(dns.TypeAAAA)...)
+	case apex && qtype == dns.TypeDNSKEY && s.keys != nil:
+		a.Answer = s.createDNSKEY()
+	case isAddressQuery(qtype) && strings.EqualFold(dns.Fqdn(query), s.getNSName()):
+		a.Answer = s.createGlue(qtype)
+	case qtype == dns.TypeSRV:
+		a.Answer, a.Extra, _ = s.getSRVRecords(query, qname)
+	case isAddressQuery(qtype):
+		var records []weightedRecord
+		for _, service := range filterHealthy(s.getServices(query)) {
+			if rr := getServiceRecord(service, qname, qtype, s.config.ttl); rr != nil {
+				records = append(records, weightedRecord{rr, getServiceWeight(service)})
+			}
+		}
+		a.Answer = s.orderRecords(query, qtype, records, rotate)
+	case qtype == dns.TypeTXT && s.config.txt:
+		for service := range s.queryServices(query) {
+			a.Answer = append(a.Answer, s.getTXTRecord(service, qname))
+		}
+	default:
 		if s.config.debug {
-			log.Println("Non-A query. We service only A in local domain, reply with SOA")
+			log.Println("Containers have only A, AAAA, SRV and TXT records in local domain, and SOA and NS at the apex")
 		}
-		m.Answer = s.createSOA()
-		w.WriteMsg(m)
+	}
+
+	if !apex || (qtype != dns.TypeSOA && qtype != dns.TypeNS) {
+		a.Answer = append(a.Answer, s.getDynamicRecords(query, qtype, qname)...)
+	}
+
+	declared, declared_exists := s.getDeclaredRecords(query, qtype, qname)
+	a.Answer = append(a.Answer, declared...)
+
+	if len(a.Answer) == 0 {
+		a.Exists = apex || declared_exists || s.countServices(query) > 0 || s.hasDynamicName(query)
 		return
 	}
+	a.Exists = true
 
-	m.Answer = make([]dns.RR, 0, 2)
+	// Echo the name exactly as the client sent it, resolvers using 0x20
+	// randomisation check the case.
+	for _, rr := range a.Answer {
+		if strings.EqualFold(rr.Header().Name, qname) {
+			rr.Header().Name = qname
+		}
+	}
+
+	return s.chaseCname(a, qtype, depth, rotate)
+}
 
-	for service := range s.queryServices(query) {
-		m.Answer = append(m.Answer,
-			getServiceRecord(service, r.Question[0].Name, s.config.ttl))
+// Record types in the answer to ANY queries, in this order.
+var anyTypes = []uint16{dns.TypeCNAME, dns.TypeSOA, dns.TypeNS, dns.TypeDNSKEY, dns.TypeA, dns.TypeAAAA, dns.TypeTXT, dns.TypeSRV, dns.TypeMX, dns.TypeCAA, dns.TypePTR}
+
+// Answers ANY query with all the records we have for the name. CNAMEs are
+// not followed. With the minimal-any option only the first RRset is returned,
+// as RFC 8482 suggests, so that ANY queries can't be used for amplification.
+func (s *DNSServer) resolveAny(query string, qname string) (a localAnswer) {
+	for _, qtype := range anyTypes {
+		t := s.lookup(query, qtype, qname, maxCnameChain, false)
+		a.Local = a.Local || t.Local
+		a.Exists = a.Exists || t.Exists
+		a.Answer = append(a.Answer, t.Answer...)
+		a.Extra = append(a.Extra, t.Extra...)
 	}
-	if len(m.Answer) == 0 {
-		m.Answer = s.createSOA()
+	a.Answer = dns.Dedup(a.Answer, nil)
+	a.Extra = dns.Dedup(a.Extra, nil)
+
+	if s.config.minimalAny && len(a.Answer) > 0 {
+		rrtype := a.Answer[0].Header().Rrtype
+		a.Answer = filterRecords(a.Answer, rrtype)
+		a.Extra = nil
 	}
+	return
+}
 
-	w.WriteMsg(m)
+// If the answer contains a CNAME and the query was for other type, the
+// target is resolved and added to the answer, if it's local. Non-local
+// targets are left for the client to resolve.
+func (s *DNSServer) chaseCname(a localAnswer, qtype uint16, depth int, rotate bool) localAnswer {
+	if qtype == dns.TypeCNAME || depth >= maxCnameChain {
+		return a
+	}
+	for _, rr := range a.Answer {
+		cname, ok := rr.(*dns.CNAME)
+		if !ok {
+			continue
+		}
+		target := s.lookup(strings.TrimSuffix(cname.Target, "."), qtype, cname.Target, depth+1, rotate)
+		if target.Local {
+			a.Answer = append(a.Answer, target.Answer...)
+			a.Extra = append(a.Extra, target.Extra...)
+		}
+		break
+	}
+	return a
+}
+
+// Turns m into a negative answer as described in RFC 2308: NXDOMAIN if the
+// name doesn't exist, NODATA (NOERROR and no answer) if it exists but has no
+// records of the requested type. The SOA goes to the authority section.
+func (s *DNSServer) setNegativeAnswer(m *dns.Msg, exists bool) {
+	if !exists {
+		m.Rcode = dns.RcodeNameError
+	}
+	m.Answer = nil
+	m.Extra = nil
+	m.Ns = s.createSOA()
+}
+
+// Returns number of services matching the query.
+func (s *DNSServer) countServices(query string) (count int) {
+	for _ = range s.queryServices(query) {
+		count++
+	}
+	return
 }
 
 func (s *DNSServer) queryServices(query string) chan *Service {
@@ -347,24 +1026,9 @@ func (s *DNSServer) queryServices(query string) chan *Service {
 		s.lock.RLock()
 
 		for _, service := range s.services {
-			tests := [][]string{
-				s.config.domain,
-				strings.Split(service.Image, "."),
-				strings.Split(service.Name, "."),
+			if s.matchesService(query, service) {
+				c <- service
 			}
-
-			for i, q := 0, query; ; i++ {
-				if len(q) == 0 || i > 2 {
-					c <- service
-					break
-				}
-
-				var matches bool
-				if matches, q = matchSuffix(q, tests[i]); !matches {
-					break
-				}
-			}
-
 		}
 
 		close(c)
@@ -375,6 +1039,58 @@ func (s *DNSServer) queryServices(query string) chan *Service {
 
 }
 
+// Returns true if the query labels match the service: parts of the name can
+// be left out from the left side and "*" matches any part.
+func (s *DNSServer) matchesService(query []string, service *Service) bool {
+	tests := [][]string{
+		s.config.domain,
+		strings.Split(service.Image, "."),
+		strings.Split(service.Name, "."),
+	}
+
+	for i, q := 0, query; ; i++ {
+		if len(q) == 0 || i > 2 {
+			return true
+		}
+
+		var matches bool
+		if matches, q = matchSuffix(q, tests[i]); !matches {
+			return false
+		}
+	}
+}
+
+// Returns true if the name has records other than CNAME: container, alias,
+// declared or dynamic records. CNAME can't live next to other data (RFC 1034
+// 3.6.2), secondaries would reject the zone. Caller must hold the lock.
+func (s *DNSServer) hasOtherData(name string) bool {
+	if _, ok := s.dynamic[dynamicKey(name)]; ok {
+		return true
+	}
+	return s.hasContainerData(name)
+}
+
+// Returns true if the name has container, alias or declared records. Caller
+// must hold the lock.
+func (s *DNSServer) hasContainerData(name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if _, ok := s.aliases[name]; ok {
+		return true
+	}
+	labels := strings.Split(name, ".")
+	for _, service := range s.services {
+		if s.IsLocal(name) && s.matchesService(labels, service) {
+			return true
+		}
+		for _, rr := range service.Records {
+			if rr.Header().Name == dns.Fqdn(name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // Checks for a partial match for container SHA and outputs it if found.
 func (s *DNSServer) getExpandedId(in string) (out string) {
 	out = in
@@ -405,11 +1121,11 @@ func (s *DNSServer) getExpandedId(in string) (out string) {
 // for a long time. The other defaults left as is(skydns source) because they
 // do not have an use case in this situation.
 func (s *DNSServer) createSOA() []dns.RR {
-	dom := dns.Fqdn(s.config.domain[len(s.config.domain)-1] + ".")
+	dom := dns.Fqdn(s.config.domain.String())
 	soa := &dns.SOA{Hdr: dns.RR_Header{Name: dom, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: uint32(s.config.ttl)},
-		Ns:      "master." + dom,
+		Ns:      s.getNSName(),
 		Mbox:    "hostmaster." + dom,
-		Serial:  uint32(time.Now().Truncate(time.Hour).Unix()),
+		Serial:  s.getSerial(),
 		Refresh: 28800,
 		Retry:   7200,
 		Expire:  604800,
@@ -418,12 +1134,56 @@ func (s *DNSServer) createSOA() []dns.RR {
 	return []dns.RR{soa}
 }
 
+// Host name of this nameserver, used in SOA and NS records of the zone.
+func (s *DNSServer) getNSName() string {
+	if s.config.nsName != "" {
+		return dns.Fqdn(s.config.nsName)
+	}
+	return dns.Fqdn("master." + s.config.domain.String())
+}
+
+func (s *DNSServer) createNS() []dns.RR {
+	dom := dns.Fqdn(s.config.domain.String())
+	ns := &dns.NS{Hdr: dns.RR_Header{Name: dom, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: uint32(s.config.ttl)},
+		Ns: s.getNSName(),
+	}
+	return []dns.RR{ns}
+}
+
+// Glue records for the nameserver host, if its address is configured.
+func (s *DNSServer) createGlue(qtype uint16) []dns.RR {
+	ip := net.ParseIP(s.config.nsAddr)
+	if ip == nil {
+		return nil
+	}
+	hdr := dns.RR_Header{Name: s.getNSName(), Rrtype: qtype, Class: dns.ClassINET, Ttl: uint32(s.config.ttl)}
+	if qtype == dns.TypeA && ip.To4() != nil {
+		return []dns.RR{&dns.A{Hdr: hdr, A: ip.To4()}}
+	}
+	if qtype == dns.TypeAAAA && ip.To4() == nil {
+		return []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: ip}}
+	}
+	return nil
+}
+
+func (s *DNSServer) getSerial() uint32 {
+	return atomic.LoadUint32(&s.serial)
+}
+
+// Called whenever the record set changes, so that secondaries know they
+// have to refresh.
+func (s *DNSServer) bumpSerial() {
+	atomic.AddUint32(&s.serial, 1)
+	s.clearSignatures()
+	s.zoneChanged()
+}
+
 func matchSuffix(str, sfx []string) (matches bool, remainder []string) {
 	for i := 1; i <= len(sfx); i++ {
 		if len(str) < i {
 			return true, nil
 		}
-		if sfx[len(sfx)-i] != str[len(str)-i] && str[len(str)-i] != "*" {
+		if !strings.EqualFold(sfx[len(sfx)-i], str[len(str)-i]) && str[len(str)-i] != "*" {
 			return false, nil
 		}
 	}
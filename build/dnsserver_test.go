@@ -2,6 +2,9 @@ package main
 
 import (
 	"net"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -44,24 +47,28 @@ func TestDNSResponse(t *testing.T) {
 
 	var inputs = []struct {
 		query    string
+		qtype    uint16
 		expected int
+		rcode    int
 	}{
-		{"docker.", 3},
-		{"*.docker.", 3},
-		{"bar.docker.", 3},
-		{"foo.docker.", 0},
-		{"baz.bar.docker.", 1},
-		{"www.seznam.cz.", 2},
-		{"www.someelse.fi.", 1},
+		{"docker.", dns.TypeA, 3, dns.RcodeSuccess},
+		{"*.docker.", dns.TypeA, 3, dns.RcodeSuccess},
+		{"bar.docker.", dns.TypeA, 3, dns.RcodeSuccess},
+		{"foo.docker.", dns.TypeA, 0, dns.RcodeNameError},
+		{"baz.bar.docker.", dns.TypeA, 1, dns.RcodeSuccess},
+		{"baz.bar.docker.", dns.TypeMX, 0, dns.RcodeSuccess},
+		{"www.seznam.cz.", dns.TypeA, 2, dns.RcodeSuccess},
+		{"www.seznam.cz.", dns.TypeMX, 0, dns.RcodeSuccess},
+		{"www.someelse.fi.", dns.TypeA, 1, dns.RcodeSuccess},
 	}
 
 	for _, input := range inputs {
-		t.Log(input.query)
+		t.Log(input.query, dns.TypeToString[input.qtype])
 		m := new(dns.Msg)
 		m.Id = dns.Id()
 		m.RecursionDesired = true
 		m.Question = []dns.Question{
-			dns.Question{input.query, dns.TypeA, dns.ClassINET},
+			dns.Question{input.query, input.qtype, dns.ClassINET},
 		}
 		c := new(dns.Client)
 		in, _, err := c.Exchange(m, TEST_ADDR)
@@ -69,16 +76,22 @@ func TestDNSResponse(t *testing.T) {
 			t.Error("Error response from the server", err)
 			break
 		}
-		if len(in.Answer) == 0 {
-			t.Error(input, "No SOA anwer")
+		if !in.Authoritative {
+			t.Error(input, "Local answer should be authoritative")
 		}
-		if _, ok := in.Answer[0].(*dns.SOA); ok {
-			if input.expected != 0 {
-				t.Error(input, "Expected:", input.expected, " Got:", 0)
-			}
-		} else if len(in.Answer) != input.expected {
+		if in.Rcode != input.rcode {
+			t.Error(input, "Expected rcode:", dns.RcodeToString[input.rcode], " Got:", dns.RcodeToString[in.Rcode])
+		}
+		if len(in.Answer) != input.expected {
 			t.Error(input, "Expected:", input.expected, " Got:", len(in.Answer))
 		}
+		if input.expected == 0 {
+			if len(in.Ns) != 1 {
+				t.Error(input, "No SOA in authority section")
+			} else if _, ok := in.Ns[0].(*dns.SOA); !ok {
+				t.Error(input, "Expected SOA in authority section, got", in.Ns[0])
+			}
+		}
 	}
 
 	// // This test is slow and pointless
@@ -92,6 +105,177 @@ func TestDNSResponse(t *testing.T) {
 	// }
 }
 
+func TestDNSResponseTCP(t *testing.T) {
+	const TEST_ADDR = "127.0.0.1:9954"
+
+	config := NewConfig()
+	config.dnsAddr = TEST_ADDR
+
+	server := NewDNSServer(config)
+	go server.Start()
+
+	// Allow some time for server to start
+	time.Sleep(250 * time.Millisecond)
+
+	// Enough containers so that the wildcard answer doesn't fit in 512 bytes
+	for i := 0; i < 50; i++ {
+		id := strconv.Itoa(i)
+		server.AddService(id, Service{Name: "web" + id, Image: "bar", Ip: net.ParseIP("127.0.0.1"), Ttl: -1})
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("*.docker.", dns.TypeA)
+
+	c := new(dns.Client)
+	in, _, err := c.Exchange(m, TEST_ADDR)
+	if err != nil {
+		t.Fatal("Error response from the server", err)
+	}
+	if !in.Truncated {
+		t.Error("UDP answer should have been truncated")
+	}
+
+	c = &dns.Client{Net: "tcp"}
+	in, _, err = c.Exchange(m, TEST_ADDR)
+	if err != nil {
+		t.Fatal("Error response from the server over TCP", err)
+	}
+	if in.Truncated {
+		t.Error("TCP answer should not be truncated")
+	}
+	if len(in.Answer) != 50 {
+		t.Error("Expected: 50 Got:", len(in.Answer))
+	}
+}
+
+func TestEDNS(t *testing.T) {
+	const TEST_ADDR = "127.0.0.1:9962"
+
+	config := NewConfig()
+	config.dnsAddr = TEST_ADDR
+	config.maxUDPSize = 1232
+
+	server := NewDNSServer(config)
+	go server.Start()
+
+	// Allow some time for server to start
+	time.Sleep(250 * time.Millisecond)
+
+	// The wildcard answer doesn't fit in 512 bytes, but fits in 1232
+	for i := 0; i < 50; i++ {
+		id := strconv.Itoa(i)
+		server.AddService(id, Service{Name: "web" + id, Image: "bar", Ip: net.ParseIP("127.0.0.1"), Ttl: -1})
+	}
+
+	inputs := []struct {
+		size      uint16
+		version   uint8
+		truncated bool
+		rcode     int
+	}{
+		{1232, 0, false, dns.RcodeSuccess},
+		{4096, 0, false, dns.RcodeSuccess},
+		{512, 0, true, dns.RcodeSuccess},
+		{100, 0, true, dns.RcodeSuccess},
+		{4096, 1, false, dns.RcodeBadVers},
+	}
+
+	c := &dns.Client{UDPSize: 4096}
+	for _, input := range inputs {
+		m := new(dns.Msg)
+		m.SetQuestion("*.docker.", dns.TypeA)
+		m.SetEdns0(input.size, false)
+		m.IsEdns0().SetVersion(input.version)
+
+		in, _, err := c.Exchange(m, TEST_ADDR)
+		if err != nil {
+			t.Fatal("Error response from the server", err)
+		}
+		if in.Rcode != input.rcode {
+			t.Error(input, "Expected rcode:", dns.RcodeToString[input.rcode], "Got:", dns.RcodeToString[in.Rcode])
+		}
+		if in.Truncated != input.truncated {
+			t.Error(input, "Expected truncated:", input.truncated, "Got:", in.Truncated)
+		}
+		opt := in.IsEdns0()
+		if opt == nil {
+			t.Error(input, "Answer should have OPT record")
+			continue
+		}
+		if opt.UDPSize() > uint16(config.maxUDPSize) {
+			t.Error(input, "Advertised size should be capped, Got:", opt.UDPSize())
+		}
+		if input.rcode == dns.RcodeSuccess && !input.truncated && len(in.Answer) != 50 {
+			t.Error(input, "Expected: 50 Got:", len(in.Answer))
+		}
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("web1.docker.", dns.TypeA)
+	in, _, err := c.Exchange(m, TEST_ADDR)
+	if err != nil {
+		t.Fatal("Error response from the server", err)
+	}
+	if in.IsEdns0() != nil {
+		t.Error("Answer to request without EDNS0 should not have OPT record")
+	}
+}
+
+func TestDNSResponseAAAA(t *testing.T) {
+	const TEST_ADDR = "127.0.0.1:9955"
+
+	config := NewConfig()
+	config.dnsAddr = TEST_ADDR
+
+	server := NewDNSServer(config)
+	go server.Start()
+
+	// Allow some time for server to start
+	time.Sleep(250 * time.Millisecond)
+
+	server.AddService("dual", Service{Name: "dual", Image: "bar", Ip: net.ParseIP("172.17.0.2"), Ipv6: net.ParseIP("2001:db8::2"), Ttl: -1, Alias: "dual.example.com"})
+	server.AddService("four", Service{Name: "four", Image: "bar", Ip: net.ParseIP("172.17.0.3"), Ttl: -1, Alias: "four.example.com"})
+	server.AddService("six", Service{Name: "six", Image: "baz", Ipv6: net.ParseIP("2001:db8::4"), Ttl: -1})
+
+	var inputs = []struct {
+		query    string
+		qtype    uint16
+		expected int
+	}{
+		{"bar.docker.", dns.TypeAAAA, 1},
+		{"bar.docker.", dns.TypeA, 2},
+		{"docker.", dns.TypeAAAA, 2},
+		{"four.bar.docker.", dns.TypeAAAA, 0},
+		{"six.baz.docker.", dns.TypeA, 0},
+		{"six.baz.docker.", dns.TypeAAAA, 1},
+		{"dual.example.com.", dns.TypeAAAA, 1},
+		{"four.example.com.", dns.TypeAAAA, 0},
+	}
+
+	for _, input := range inputs {
+		t.Log(input.query, dns.TypeToString[input.qtype])
+		m := new(dns.Msg)
+		m.SetQuestion(input.query, input.qtype)
+		c := new(dns.Client)
+		in, _, err := c.Exchange(m, TEST_ADDR)
+		if err != nil {
+			t.Error("Error response from the server", err)
+			break
+		}
+		if len(in.Answer) != input.expected {
+			t.Error(input, "Expected:", input.expected, " Got:", len(in.Answer))
+		}
+		if input.expected == 0 && len(in.Ns) == 0 {
+			t.Error(input, "Empty answer should carry SOA in authority section")
+		}
+		for _, rr := range in.Answer {
+			if rr.Header().Rrtype != input.qtype {
+				t.Error(input, "Unexpected record type", rr)
+			}
+		}
+	}
+}
+
 func TestServiceManagement(t *testing.T) {
 	list := ServiceListProvider(NewDNSServer(NewConfig()))
 
@@ -325,3 +509,448 @@ func TestGetExpandedId(t *testing.T) {
 	}
 
 }
+
+func TestReverseLookup(t *testing.T) {
+	s := NewDNSServer(NewConfig())
+	s.AddService("foo", Service{Name: "foo", Image: "bar", Ip: net.ParseIP("172.17.0.2"), Ipv6: net.ParseIP("2001:db8::2"), Ttl: -1, Alias: "www.seznam.cz"})
+	s.AddService("baz", Service{Name: "baz", Image: "bar", Ip: net.ParseIP("172.17.0.3"), Ttl: -1})
+
+	inputs := []struct {
+		name     string
+		expected []string
+	}{
+		{"2.0.17.172.in-addr.arpa", []string{"foo.bar.docker.", "www.seznam.cz."}},
+		{"2.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa", []string{"foo.bar.docker.", "www.seznam.cz."}},
+		{"3.0.17.172.in-addr.arpa", []string{"baz.bar.docker."}},
+		{"4.0.17.172.in-addr.arpa", nil},
+	}
+
+	for _, input := range inputs {
+		t.Log(input.name)
+		records := s.getReverseRecords(input.name, input.name+".")
+		if len(records) != len(input.expected) {
+			t.Error(input.name, "Expected:", input.expected, "Got:", records)
+			continue
+		}
+		for i, rr := range records {
+			if ptr := rr.(*dns.PTR).Ptr; ptr != input.expected[i] {
+				t.Error(input.name, "Expected:", input.expected[i], "Got:", ptr)
+			}
+		}
+	}
+
+	// restart with a new address drops the old reverse entry
+	s.AddService("baz", Service{Name: "baz", Image: "bar", Ip: net.ParseIP("172.17.0.5"), Ttl: -1})
+	if _, ok := s.reverse["3.0.17.172.in-addr.arpa"]; ok {
+		t.Error("Stale reverse entry after service update")
+	}
+
+	s.RemoveService("foo")
+	s.RemoveService("baz")
+	if len(s.reverse) != 0 {
+		t.Error("reverse map should be empty")
+	}
+}
+
+func TestSRVRecords(t *testing.T) {
+	s := NewDNSServer(NewConfig())
+	s.AddService("foo", Service{Name: "foo", Image: "bar", Ip: net.ParseIP("172.17.0.2"), Ttl: -1,
+		Ports: []ServicePort{{"http", 80, "tcp"}, {"", 8080, "tcp"}}})
+	s.AddService("baz", Service{Name: "baz", Image: "bar", Ip: net.ParseIP("172.17.0.3"), Ipv6: net.ParseIP("2001:db8::3"), Ttl: -1,
+		Ports: []ServicePort{{"http", 80, "tcp"}, {"domain", 53, "udp"}}})
+
+	inputs := []struct {
+		query           string
+		answers, extras int
+		matched         bool
+	}{
+		{"_http._tcp.foo.bar.docker", 1, 1, true},
+		{"_http._tcp.bar.docker", 2, 3, true},
+		{"_8080._tcp.bar.docker", 1, 1, true},
+		{"_80._tcp.baz.bar.docker", 1, 2, true},
+		{"_domain._udp.*.docker", 1, 2, true},
+		{"_domain._tcp.bar.docker", 0, 0, true},
+		{"_http._tcp.nothing.docker", 0, 0, false},
+		{"foo.bar.docker", 0, 0, false},
+	}
+
+	for _, input := range inputs {
+		t.Log(input.query)
+		answer, extra, matched := s.getSRVRecords(input.query, input.query+".")
+		if len(answer) != input.answers || len(extra) != input.extras || matched != input.matched {
+			t.Error(input, "Got:", answer, extra, matched)
+		}
+	}
+
+	answer, _, _ := s.getSRVRecords("_8080._tcp.foo.bar.docker", "_8080._tcp.foo.bar.docker.")
+	if srv := answer[0].(*dns.SRV); srv.Port != 8080 || srv.Target != "foo.bar.docker." {
+		t.Error("Invalid SRV record", srv)
+	}
+}
+
+func TestZoneApex(t *testing.T) {
+	const TEST_ADDR = "127.0.0.1:9956"
+
+	config := NewConfig()
+	config.dnsAddr = TEST_ADDR
+	config.domain = NewDomain("docker.corp")
+	config.nsName = "ns1.docker.corp"
+	config.nsAddr = "10.0.0.53"
+
+	server := NewDNSServer(config)
+	go server.Start()
+
+	// Allow some time for server to start
+	time.Sleep(250 * time.Millisecond)
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		in, _, err := new(dns.Client).Exchange(m, TEST_ADDR)
+		if err != nil {
+			t.Fatal("Error response from the server", err)
+		}
+		return in
+	}
+
+	in := query("docker.corp.", dns.TypeSOA)
+	if len(in.Answer) != 1 || !in.Authoritative {
+		t.Fatal("Expected authoritative SOA answer, got", in)
+	}
+	soa := in.Answer[0].(*dns.SOA)
+	if soa.Hdr.Name != "docker.corp." || soa.Ns != "ns1.docker.corp." {
+		t.Error("Invalid SOA", soa)
+	}
+
+	in = query("docker.corp.", dns.TypeNS)
+	if len(in.Answer) != 1 || in.Answer[0].(*dns.NS).Ns != "ns1.docker.corp." {
+		t.Error("Invalid NS answer", in.Answer)
+	}
+	if len(in.Extra) != 1 || !in.Extra[0].(*dns.A).A.Equal(net.ParseIP("10.0.0.53")) {
+		t.Error("Invalid glue", in.Extra)
+	}
+
+	in = query("ns1.docker.corp.", dns.TypeA)
+	if len(in.Answer) != 1 {
+		t.Error("Nameserver host name should resolve to the glue address", in.Answer)
+	}
+
+	in = query("docker.corp.", dns.TypeMX)
+	if len(in.Answer) != 0 || in.Rcode != dns.RcodeSuccess {
+		t.Error("Expected NODATA for MX at apex, got", in)
+	}
+
+	server.AddService("foo", Service{Name: "foo", Image: "bar", Ip: net.ParseIP("127.0.0.1"), Ttl: -1})
+	in = query("docker.corp.", dns.TypeSOA)
+	if serial := in.Answer[0].(*dns.SOA).Serial; serial <= soa.Serial {
+		t.Error("Serial should increase after AddService", soa.Serial, serial)
+	}
+	soa = in.Answer[0].(*dns.SOA)
+
+	server.RemoveService("foo")
+	in = query("docker.corp.", dns.TypeSOA)
+	if serial := in.Answer[0].(*dns.SOA).Serial; serial <= soa.Serial {
+		t.Error("Serial should increase after RemoveService", soa.Serial, serial)
+	}
+}
+
+func TestCnameAlias(t *testing.T) {
+	s := NewDNSServer(NewConfig())
+
+	s.AddService("web1", Service{Name: "web", Image: "myapp", Ip: net.ParseIP("172.17.0.2"), Ttl: -1})
+	s.AddService("proxy", Service{Name: "proxy", Image: "nginx", Ip: net.ParseIP("172.17.0.9"), Ttl: -1,
+		Cname: "api.internal:web.myapp.docker,proxy.internal,ext.internal:www.example.com,loop1.docker:loop2.docker,loop2.docker:loop1.docker"})
+
+	inputs := []struct {
+		query    string
+		qtype    uint16
+		expected []string
+	}{
+		{"api.internal", dns.TypeA, []string{"CNAME web.myapp.docker.", "A 172.17.0.2"}},
+		{"api.internal", dns.TypeCNAME, []string{"CNAME web.myapp.docker."}},
+		{"api.internal", dns.TypeAAAA, []string{"CNAME web.myapp.docker."}},
+		{"proxy.internal", dns.TypeA, []string{"CNAME proxy.nginx.docker.", "A 172.17.0.9"}},
+		{"ext.internal", dns.TypeA, []string{"CNAME www.example.com."}},
+	}
+
+	for _, input := range inputs {
+		t.Log(input.query, dns.TypeToString[input.qtype])
+		a := s.resolve(input.query, input.qtype, input.query+".", 0)
+		if !a.Local || !a.Exists {
+			t.Error(input, "CNAME alias should be local and exist")
+		}
+		var actual []string
+		for _, rr := range a.Answer {
+			switch rr := rr.(type) {
+			case *dns.CNAME:
+				actual = append(actual, "CNAME "+rr.Target)
+			case *dns.A:
+				actual = append(actual, "A "+rr.A.String())
+			}
+		}
+		if !reflect.DeepEqual(actual, input.expected) {
+			t.Error(input, "Expected:", input.expected, "Got:", actual)
+		}
+	}
+
+	// CNAME loop doesn't hang
+	if a := s.resolve("loop1.docker", dns.TypeA, "loop1.docker.", 0); len(a.Answer) != maxCnameChain+1 {
+		t.Error("CNAME chain should be cut, got", len(a.Answer))
+	}
+
+	// target container is replaced, CNAME follows
+	s.RemoveService("web1")
+	s.AddService("web2", Service{Name: "web", Image: "myapp", Ip: net.ParseIP("172.17.0.3"), Ttl: -1})
+	a := s.resolve("api.internal", dns.TypeA, "api.internal.", 0)
+	if len(a.Answer) != 2 || !a.Answer[1].(*dns.A).A.Equal(net.ParseIP("172.17.0.3")) {
+		t.Error("CNAME should follow the replaced container, got", a.Answer)
+	}
+
+	s.RemoveService("proxy")
+	if len(s.cnames) != 0 {
+		t.Error("cnames map should be empty")
+	}
+}
+
+func TestCnameConflicts(t *testing.T) {
+	s := NewDNSServer(NewConfig())
+
+	mx, _ := dns.NewRR("mail.docker. 60 IN MX 10 mx.example.com.")
+	s.AddService("web", Service{Name: "web", Image: "myapp", Ip: net.ParseIP("172.17.0.2"), Ttl: -1, Alias: "www.example.com",
+		Records: []dns.RR{mx}})
+	s.AddService("evil", Service{Name: "evil", Image: "other", Ip: net.ParseIP("172.17.0.3"), Ttl: -1,
+		Cname: "web.myapp.docker:elsewhere.example.com,myapp.docker:elsewhere.example.com,x.web.myapp.docker:elsewhere.example.com," +
+			"www.example.com:elsewhere.example.com,mail.docker:elsewhere.example.com,api.shop.docker:elsewhere.example.com"})
+
+	for _, name := range []string{"web.myapp.docker", "myapp.docker", "x.web.myapp.docker", "www.example.com", "mail.docker"} {
+		if _, ok := s.cnames[name]; ok {
+			t.Error(name, "CNAME next to other records should be refused")
+		}
+		if a := s.resolve(name, dns.TypeCNAME, name+".", 0); len(a.Answer) != 0 {
+			t.Error(name, "Expected no CNAME, Got:", a.Answer)
+		}
+	}
+	if _, ok := s.cnames["api.shop.docker"]; !ok {
+		t.Error("CNAME without other records should be added")
+	}
+
+	// Container with the name of an existing CNAME hides it, the zone never
+	// has CNAME and other records at one name.
+	s.AddService("api", Service{Name: "api", Image: "shop", Ip: net.ParseIP("172.17.0.4"), Ttl: -1})
+	a := s.resolve("api.shop.docker", dns.TypeA, "api.shop.docker.", 0)
+	if len(a.Answer) != 1 || a.Answer[0].Header().Rrtype != dns.TypeA {
+		t.Error("Expected the A record of the container, Got:", a.Answer)
+	}
+	for _, rr := range s.getZoneSnapshot() {
+		if rr.Header().Rrtype == dns.TypeCNAME {
+			t.Error("Unexpected CNAME in the zone", rr)
+		}
+	}
+}
+
+func TestTXTRecords(t *testing.T) {
+	s := NewDNSServer(NewConfig())
+
+	s.AddService("foo", Service{Name: "web", Image: "myapp", Ip: net.ParseIP("172.17.0.2"), Ttl: -1, Alias: "www.seznam.cz",
+		Meta: ServiceMeta{
+			Id:         "416261e74515",
+			Image:      "registry.example.com/team/myapp:1.2",
+			Created:    "2015-06-01T10:00:00Z",
+			Started:    "2015-06-01T10:00:01Z",
+			NameSource: "DNSDOCK_NAME",
+			Labels:     map[string]string{"team": "ops", "env": "test"},
+		}})
+
+	expected := []string{
+		"id=416261e74515",
+		"image=registry.example.com/team/myapp:1.2",
+		"created=2015-06-01T10:00:00Z",
+		"started=2015-06-01T10:00:01Z",
+		"name-source=DNSDOCK_NAME",
+		"label:env=test",
+		"label:team=ops",
+	}
+
+	for _, query := range []string{"web.myapp.docker", "www.seznam.cz"} {
+		a := s.resolve(query, dns.TypeTXT, query+".", 0)
+		if len(a.Answer) != 1 {
+			t.Error(query, "Expected one TXT record, got", a.Answer)
+			continue
+		}
+		if actual := a.Answer[0].(*dns.TXT).Txt; !reflect.DeepEqual(actual, expected) {
+			t.Error(query, "Expected:", expected, "Got:", actual)
+		}
+	}
+
+	// Values over 255 bytes are split, the record can be packed and
+	// transferred.
+	long := strings.Repeat("x", 300)
+	s.AddService("bar", Service{Name: "long", Image: "myapp", Ip: net.ParseIP("172.17.0.3"), Ttl: -1,
+		Meta: ServiceMeta{Labels: map[string]string{"description": long}}})
+	a := s.resolve("long.myapp.docker", dns.TypeTXT, "long.myapp.docker.", 0)
+	if len(a.Answer) != 1 {
+		t.Fatal("Expected one TXT record, got", a.Answer)
+	}
+	txt := a.Answer[0].(*dns.TXT).Txt
+	if last := txt[len(txt)-2:]; last[0] != ("label:description=" + long)[:255] || last[1] != long[255-len("label:description="):] {
+		t.Error("Expected the label split at 255 bytes, Got:", last)
+	}
+	m := new(dns.Msg)
+	m.SetQuestion("long.myapp.docker.", dns.TypeTXT)
+	m.Answer = a.Answer
+	if _, err := m.Pack(); err != nil {
+		t.Error("Can't pack the TXT record", err)
+	}
+	m.Answer = s.getZoneSnapshot()
+	if _, err := m.Pack(); err != nil {
+		t.Error("Can't pack the zone", err)
+	}
+
+	s.config.txt = false
+	if a := s.resolve("web.myapp.docker", dns.TypeTXT, "web.myapp.docker.", 0); len(a.Answer) != 0 || !a.Exists {
+		t.Error("TXT records should be turned off, got", a.Answer)
+	}
+}
+
+func TestAnyQuery(t *testing.T) {
+	config := NewConfig()
+	s := NewDNSServer(config)
+
+	s.AddService("web1", Service{Name: "web", Image: "myapp", Ip: net.ParseIP("172.17.0.2"), Ipv6: net.ParseIP("2001:db8::2"), Ttl: -1,
+		Alias: "www.example.com", Cname: "api.internal:web.myapp.docker", Ports: []ServicePort{{"http", 80, "tcp"}}})
+
+	inputs := []struct {
+		query    string
+		minimal  bool
+		expected []string
+	}{
+		{"web.myapp.docker", false, []string{"A", "AAAA", "TXT"}},
+		{"web.myapp.docker", true, []string{"A"}},
+		{"www.example.com", false, []string{"A", "AAAA", "TXT"}},
+		{"api.internal", false, []string{"CNAME"}},
+		// Names match the same containers as for A queries
+		{"_http._tcp.web.myapp.docker", false, []string{"A", "AAAA", "TXT", "SRV"}},
+		{"docker", false, []string{"SOA", "NS", "A", "AAAA", "TXT"}},
+		{"docker", true, []string{"SOA"}},
+		{"nothing.docker", false, nil},
+	}
+
+	for _, input := range inputs {
+		config.minimalAny = input.minimal
+		a := s.resolve(input.query, dns.TypeANY, input.query+".", 0)
+		if !a.Local {
+			t.Error(input, "ANY query should be answered locally")
+		}
+		if a.Exists != (input.expected != nil) {
+			t.Error(input, "Expected exists:", input.expected != nil, "Got:", a.Exists)
+		}
+		var actual []string
+		for _, rr := range a.Answer {
+			actual = append(actual, dns.TypeToString[rr.Header().Rrtype])
+		}
+		if !reflect.DeepEqual(actual, input.expected) {
+			t.Error(input, "Expected:", input.expected, "Got:", actual)
+		}
+	}
+
+	config.minimalAny = false
+	if a := s.resolve("www.seznam.cz", dns.TypeANY, "www.seznam.cz.", 0); a.Local {
+		t.Error("ANY query for foreign name should be forwarded")
+	}
+}
+
+func TestWildcardAlias(t *testing.T) {
+	s := NewDNSServer(NewConfig())
+
+	s.AddService("preview", Service{Name: "preview", Image: "myapp", Ip: net.ParseIP("172.17.0.2"), Ttl: -1, Alias: "*.preview.local"})
+	s.AddService("tenant", Service{Name: "tenant", Image: "myapp", Ip: net.ParseIP("172.17.0.3"), Ttl: -1, Alias: "*.acme.preview.local,www.acme.preview.local"})
+	s.AddService("www", Service{Name: "www", Image: "myapp", Ip: net.ParseIP("172.17.0.4"), Ttl: -1, Alias: "api.preview.local"})
+	s.AddService("invalid", Service{Name: "invalid", Image: "myapp", Ip: net.ParseIP("172.17.0.5"), Ttl: -1, Alias: "*,foo.*.local,*.-bad.local"})
+
+	inputs := []struct {
+		query    string
+		expected string
+	}{
+		{"foo.preview.local", "172.17.0.2"},
+		{"a.b.preview.local", "172.17.0.2"},
+		// exact alias wins
+		{"api.preview.local", "172.17.0.4"},
+		// more specific wildcard wins
+		{"shop.acme.preview.local", "172.17.0.3"},
+		{"www.acme.preview.local", "172.17.0.3"},
+		{"acme.preview.local", "172.17.0.2"},
+		// wildcard doesn't match the suffix itself
+		{"preview.local", ""},
+	}
+
+	for _, input := range inputs {
+		a := s.resolve(input.query, dns.TypeA, input.query+".", 0)
+		var actual string
+		if len(a.Answer) == 1 {
+			actual = a.Answer[0].(*dns.A).A.String()
+		}
+		if actual != input.expected || len(a.Answer) > 1 {
+			t.Error(input.query, "Expected:", input.expected, "Got:", a.Answer)
+		}
+	}
+
+	if _, ok := s.aliases["*.preview.local"]; !ok {
+		t.Error("Wildcard alias should be registered")
+	}
+	for _, alias := range []string{"*", "foo.*.local", "*.-bad.local"} {
+		if _, ok := s.aliases[alias]; ok {
+			t.Error("Invalid wildcard alias", alias, "should be rejected")
+		}
+	}
+
+	// Wildcard aliases are not PTR targets
+	a := s.resolve("2.0.17.172.in-addr.arpa", dns.TypePTR, "2.0.17.172.in-addr.arpa.", 0)
+	if len(a.Answer) != 1 {
+		t.Error("Expected only the canonical name, Got:", a.Answer)
+	}
+
+	s.RemoveService("preview")
+	if a := s.resolve("foo.preview.local", dns.TypeA, "foo.preview.local.", 0); a.Local {
+		t.Error("Removed wildcard alias should not match")
+	}
+}
+
+func TestCaseInsensitiveMatching(t *testing.T) {
+	config := NewConfig()
+	config.domain = NewDomain("Docker")
+	s := NewDNSServer(config)
+
+	s.AddService("web1", Service{Name: "Web", Image: "MyApp", Ip: net.ParseIP("172.17.0.2"), Ttl: -1,
+		Alias: "www.Seznam.cz,*.Preview.local", Cname: "API.internal", Ports: []ServicePort{{"http", 80, "tcp"}}})
+
+	inputs := []struct {
+		qname string
+		qtype uint16
+	}{
+		{"WWW.seznam.CZ.", dns.TypeA},
+		{"www.seznam.cz.", dns.TypeA},
+		{"FoO.pReViEw.LoCaL.", dns.TypeA},
+		{"wEb.MYAPP.docker.", dns.TypeA},
+		{"web.myapp.DOCKER.", dns.TypeA},
+		{"_HTTP._tcp.Web.MyApp.Docker.", dns.TypeSRV},
+		{"api.INTERNAL.", dns.TypeCNAME},
+		{"DoCkEr.", dns.TypeSOA},
+		{"2.0.17.172.IN-ADDR.ARPA.", dns.TypePTR},
+	}
+
+	for _, input := range inputs {
+		a := s.resolve(strings.TrimSuffix(input.qname, "."), input.qtype, input.qname, 0)
+		if len(a.Answer) == 0 {
+			t.Error(input.qname, "Expected answer")
+		}
+		for _, rr := range a.Answer {
+			if rr.Header().Name != input.qname {
+				t.Error(input.qname, "Answer should echo the question name, Got:", rr.Header().Name)
+			}
+		}
+	}
+
+	if _, ok := s.aliases["www.seznam.cz"]; !ok {
+		t.Error("Alias should be stored lowercase", s.aliases)
+	}
+}
@@ -4,9 +4,12 @@ import (
 	"errors"
 	"log"
 	"net"
+	"net/url"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/samalba/dockerclient"
 )
@@ -71,12 +74,48 @@ func (d *DockerManager) getService(id string) (*Service, error) {
 	}
 	service.Name = cleanContainerName(inspect.Name)
 	service.Ip = net.ParseIP(inspect.NetworkSettings.IpAddress)
+	service.Ipv6 = getIpv6(inspect)
+	service.Ports = getPorts(inspect.Config.ExposedPorts)
+	service.Meta = ServiceMeta{
+		Id:         inspect.Id,
+		Image:      inspect.Config.Image,
+		Created:    inspect.Created,
+		NameSource: "container name",
+		Labels:     filterLabels(inspect.Config.Labels, d.config.txtLabels),
+	}
+	if inspect.State != nil && !inspect.State.StartedAt.IsZero() {
+		service.Meta.Started = inspect.State.StartedAt.UTC().Format(time.RFC3339)
+	}
+
+	service.Health = d.getHealth(inspect.Id)
+	if v, ok := inspect.Config.Labels["dnsdock.ignore-health"]; ok {
+		service.IgnoreHealth, _ = strconv.ParseBool(v)
+	}
+	if v, ok := inspect.Config.Labels["dnsdock.weight"]; ok {
+		if weight, err := strconv.Atoi(v); err == nil && weight > 0 {
+			service.Weight = weight
+		} else {
+			log.Println("Invalid weight", v, "of container", service.Name)
+		}
+	}
 
-	service = overrideFromEnv(service, splitEnv(inspect.Config.Env))
+	env := splitEnv(inspect.Config.Env)
+	service = overrideFromEnv(service, env)
 	if service == nil {
 		return nil, errors.New("Skipping " + id)
 	}
 
+	ttl := service.Ttl
+	if ttl == -1 {
+		ttl = d.config.ttl
+	}
+	records, errs := parseRecordDeclarations(getRecordDeclarations(env, inspect.Config.Labels),
+		canonicalName(service, d.config.domain), d.config.domain, ttl)
+	for k, err := range errs {
+		log.Println("Invalid record", k, "of container", service.Name+":", err)
+	}
+	service.Records = records
+
 	return service, nil
 }
 
@@ -95,9 +134,61 @@ func (d *DockerManager) eventCallback(event *dockerclient.Event, ec chan error,
 		}
 
 		d.list.AddService(event.Id, *service)
+	case "health_status: healthy", "health_status: unhealthy":
+		service, err := d.list.GetService(event.Id)
+		if err != nil {
+			// Ignored container
+			return
+		}
+		health := strings.TrimPrefix(event.Status, "health_status: ")
+		if service.Health != health {
+			if d.config.verbose {
+				log.Println("Container", service.Name, "is", health)
+			}
+			d.list.SetHealth(event.Id, health)
+		}
 	}
 }
 
+// Returns the health of the container. Our docker client doesn't know the
+// Health of the container state, so it's read from the container list like
+// docker ps shows it.
+func (d *DockerManager) getHealth(id string) string {
+	containers, err := d.docker.ListContainers(true, false, url.QueryEscape(`{"id":["`+id+`"]}`))
+	if err != nil {
+		log.Println("Can't get health of container", id, err)
+		return ""
+	}
+	for _, container := range containers {
+		if container.Id == id {
+			return parseHealth(container.Status)
+		}
+	}
+	return ""
+}
+
+// Returns the global IPv6 address of the container. It's in the settings of
+// each network, the network with the IPv4 address of the container is
+// preferred, otherwise the first network which has one.
+func getIpv6(inspect *dockerclient.ContainerInfo) net.IP {
+	names := make([]string, 0, len(inspect.NetworkSettings.Networks))
+	for name, network := range inspect.NetworkSettings.Networks {
+		if network != nil && network.GlobalIPv6Address != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if inspect.NetworkSettings.Networks[name].IPAddress == inspect.NetworkSettings.IpAddress {
+			return net.ParseIP(inspect.NetworkSettings.Networks[name].GlobalIPv6Address)
+		}
+	}
+	if len(names) > 0 {
+		return net.ParseIP(inspect.NetworkSettings.Networks[names[0]].GlobalIPv6Address)
+	}
+	return nil
+}
+
 func getImageName(tag string) string {
 	if index := strings.LastIndex(tag, "/"); index != -1 {
 		tag = tag[index+1:]
@@ -125,6 +216,70 @@ func cleanContainerName(name string) string {
 	return strings.Replace(name, "/", "", -1)
 }
 
+// Names of services on well known ports, used for SRV records when the
+// container doesn't name the port with SERVICE_<port>_NAME.
+var wellKnownPorts = map[int]string{
+	21:    "ftp",
+	22:    "ssh",
+	25:    "smtp",
+	53:    "domain",
+	80:    "http",
+	443:   "https",
+	3306:  "mysql",
+	5432:  "postgresql",
+	5672:  "amqp",
+	6379:  "redis",
+	11211: "memcache",
+	27017: "mongodb",
+}
+
+// Converts exposed ports of the container ("80/tcp") to the service ports.
+// Unparseable entries are skipped. Ports are sorted so that the SRV answers
+// are stable.
+func getPorts(exposed map[string]struct{}) (ports []ServicePort) {
+	for spec := range exposed {
+		parts := strings.SplitN(spec, "/", 2)
+		port, err := strconv.Atoi(parts[0])
+		if err != nil || port <= 0 || port > 65535 {
+			log.Println("Invalid exposed port", spec)
+			continue
+		}
+		protocol := "tcp"
+		if len(parts) == 2 {
+			protocol = strings.ToLower(parts[1])
+		}
+		ports = append(ports, ServicePort{
+			Name:     wellKnownPorts[port],
+			Port:     uint16(port),
+			Protocol: protocol,
+		})
+	}
+	sort.Sort(byPort(ports))
+	return
+}
+
+type byPort []ServicePort
+
+func (p byPort) Len() int      { return len(p) }
+func (p byPort) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p byPort) Less(i, j int) bool {
+	if p[i].Port != p[j].Port {
+		return p[i].Port < p[j].Port
+	}
+	return p[i].Protocol < p[j].Protocol
+}
+
+// Returns the labels which are in the wanted list.
+func filterLabels(labels map[string]string, wanted []string) map[string]string {
+	out := make(map[string]string)
+	for _, label := range wanted {
+		if v, ok := labels[label]; ok {
+			out[label] = v
+		}
+	}
+	return out
+}
+
 func splitEnv(in []string) (out map[string]string) {
 	out = make(map[string]string, len(in))
 	for _, exp := range in {
@@ -143,10 +298,12 @@ func overrideFromEnv(in *Service, env map[string]string) (out *Service) {
 
 		if k == "DNSDOCK_NAME" {
 			in.Name = v
+			in.Meta.NameSource = k
 		}
 
 		if k == "SERVICE_TAGS" {
 			in.Name = strings.Split(v, ",")[0]
+			in.Meta.NameSource = k
 		}
 
 		if k == "DNSDOCK_IMAGE" || k == "SERVICE_NAME" {
@@ -159,6 +316,18 @@ func overrideFromEnv(in *Service, env map[string]string) (out *Service) {
 			}
 		}
 
+		if k == "DNSDOCK_IGNORE_HEALTH" {
+			if ignore, err := strconv.ParseBool(v); err == nil {
+				in.IgnoreHealth = ignore
+			}
+		}
+
+		if k == "DNSDOCK_WEIGHT" {
+			if weight, err := strconv.Atoi(v); err == nil && weight > 0 {
+				in.Weight = weight
+			}
+		}
+
 		if k == "SERVICE_REGION" {
 			region = v
 		}
@@ -166,6 +335,21 @@ func overrideFromEnv(in *Service, env map[string]string) (out *Service) {
 		if k == "DNSDOCK_ALIAS" {
 			in.Alias = v
 		}
+
+		if k == "DNSDOCK_CNAME" {
+			in.Cname = v
+		}
+
+		// SERVICE_<port>_NAME names the port for SRV records
+		if len(k) > len("SERVICE__NAME") && strings.HasPrefix(k, "SERVICE_") && strings.HasSuffix(k, "_NAME") {
+			if port, err := strconv.Atoi(k[len("SERVICE_") : len(k)-len("_NAME")]); err == nil {
+				for i := range in.Ports {
+					if int(in.Ports[i].Port) == port {
+						in.Ports[i].Name = v
+					}
+				}
+			}
+		}
 	}
 
 	if len(region) > 0 {
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/samalba/dockerclient"
 )
 
 func TestGetImageName(t *testing.T) {
@@ -55,6 +61,28 @@ func TestCleanContainerName(t *testing.T) {
 	}
 }
 
+func TestGetPorts(t *testing.T) {
+	input := map[string]struct{}{"8080/tcp": {}, "80/tcp": {}, "53/udp": {}, "nonsense/tcp": {}}
+	expected := []ServicePort{
+		{"domain", 53, "udp"},
+		{"http", 80, "tcp"},
+		{"", 8080, "tcp"},
+	}
+	actual := getPorts(input)
+	if eq := reflect.DeepEqual(actual, expected); !eq {
+		t.Error(input, "Expected:", expected, "Got:", actual)
+	}
+}
+
+func TestFilterLabels(t *testing.T) {
+	labels := map[string]string{"team": "ops", "env": "test", "secret": "x"}
+	expected := map[string]string{"team": "ops", "env": "test"}
+	actual := filterLabels(labels, []string{"team", "env", "missing"})
+	if eq := reflect.DeepEqual(actual, expected); !eq {
+		t.Error(labels, "Expected:", expected, "Got:", actual)
+	}
+}
+
 func TestSplitEnv(t *testing.T) {
 	input := []string{"FOO=something ", "BAR_BAZ=dsfjds sadf asd"}
 	expected := map[string]string{
@@ -88,15 +116,108 @@ func TestOverrideFromEnv(t *testing.T) {
 	}
 
 	s = getService()
-	s = overrideFromEnv(s, map[string]string{"DNSDOCK_NAME": "master", "DNSDOCK_IMAGE": "mysql", "DNSDOCK_TTL": "22", "DNSDOCK_ALIAS": "alias.fi"})
-	if s.Name != "master" || s.Image != "mysql" || s.Ttl != 22 || s.Alias != "alias.fi" {
+	s = overrideFromEnv(s, map[string]string{"DNSDOCK_NAME": "master", "DNSDOCK_IMAGE": "mysql", "DNSDOCK_TTL": "22", "DNSDOCK_ALIAS": "alias.fi", "DNSDOCK_CNAME": "db.fi"})
+	if s.Name != "master" || s.Image != "mysql" || s.Ttl != 22 || s.Alias != "alias.fi" || s.Cname != "db.fi" || s.Meta.NameSource != "DNSDOCK_NAME" {
 		t.Error("Invalid DNSDOCK override", s)
 	}
 
 	s = getService()
 	s = overrideFromEnv(s, map[string]string{"SERVICE_TAGS": "master,something", "SERVICE_NAME": "mysql", "SERVICE_REGION": "us2"})
-	if s.Name != "master" || s.Image != "mysql.us2" {
+	if s.Name != "master" || s.Image != "mysql.us2" || s.Meta.NameSource != "SERVICE_TAGS" {
 		t.Error("Invalid SERVICE overrid", s)
 	}
 
+	s = getService()
+	s.Ports = []ServicePort{{"http", 80, "tcp"}, {"", 8080, "tcp"}}
+	s = overrideFromEnv(s, map[string]string{"SERVICE_8080_NAME": "admin", "SERVICE_NAME": "web"})
+	if s.Ports[0].Name != "http" || s.Ports[1].Name != "admin" || s.Image != "web" {
+		t.Error("Invalid port name override", s)
+	}
+
+	s = getService()
+	s = overrideFromEnv(s, map[string]string{"DNSDOCK_WEIGHT": "5"})
+	if s.Weight != 5 {
+		t.Error("Invalid weight override", s)
+	}
+
+	s = getService()
+	s = overrideFromEnv(s, map[string]string{"DNSDOCK_IGNORE_HEALTH": "true"})
+	if !s.IgnoreHealth {
+		t.Error("Invalid health opt-out override", s)
+	}
+
+	s = getService()
+	s = overrideFromEnv(s, map[string]string{"DNSDOCK_WEIGHT": "-1"})
+	if s.Weight != 0 {
+		t.Error("Invalid weight should be ignored", s)
+	}
+
+}
+
+func TestGetService(t *testing.T) {
+	const inspect = `{
+		"Id": "0123456789abcdef",
+		"Name": "/web",
+		"Image": "sha256:4e3b2c1",
+		"Config": {"Image": "nginx:latest", "Env": ["DNSDOCK_TTL=10"]},
+		"NetworkSettings": {
+			"IpAddress": "172.17.0.2",
+			"Networks": {
+				"back": {"IPAddress": "172.19.0.2", "GlobalIPv6Address": "fd00:19::2"},
+				"bridge": {"IPAddress": "172.17.0.2", "GlobalIPv6Address": "fd00:17::2"},
+				"none": {}
+			}
+		}
+	}`
+	docker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/containers/0123456789abcdef/json"):
+			w.Write([]byte(inspect))
+		case strings.HasSuffix(r.URL.Path, "/containers/json"):
+			w.Write([]byte(`[{"Id": "0123456789abcdef", "Status": "Up 5 minutes (healthy)"}]`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer docker.Close()
+
+	config := NewConfig()
+	config.dockerHost = docker.URL
+	d, err := NewDockerManager(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service, err := d.getService("0123456789abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if service.Name != "web" || service.Image != "nginx" || service.Ttl != 10 || service.Health != healthHealthy {
+		t.Error("Invalid service", service)
+	}
+	if !service.Ip.Equal(net.ParseIP("172.17.0.2")) {
+		t.Error("Expected IPv4 172.17.0.2, Got:", service.Ip)
+	}
+	// The network of the IPv4 address wins over the first one by name.
+	if !service.Ipv6.Equal(net.ParseIP("fd00:17::2")) {
+		t.Error("Expected IPv6 fd00:17::2, Got:", service.Ipv6)
+	}
+}
+
+func TestGetIpv6(t *testing.T) {
+	inspect := &dockerclient.ContainerInfo{}
+	if ip := getIpv6(inspect); ip != nil {
+		t.Error("Expected no IPv6 without networks, Got:", ip)
+	}
+
+	inspect.NetworkSettings.IpAddress = "172.17.0.2"
+	inspect.NetworkSettings.Networks = map[string]*dockerclient.EndpointSettings{
+		"bridge": {IPAddress: "172.17.0.2"},
+		"front":  {IPAddress: "172.20.0.2", GlobalIPv6Address: "fd00:20::2"},
+		"back":   {IPAddress: "172.19.0.2", GlobalIPv6Address: "fd00:19::2"},
+	}
+	// The network of the IPv4 address has no IPv6, the first one with it is used.
+	if ip := getIpv6(inspect); !ip.Equal(net.ParseIP("fd00:19::2")) {
+		t.Error("Expected fd00:19::2, Got:", ip)
+	}
 }
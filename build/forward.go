@@ -0,0 +1,54 @@
+package main
+
+import (
+	"log"
+	"sort"
+
+	"github.com/miekg/dns"
+)
+
+// Nameservers for names under the domain.
+type forwardRule struct {
+	domain    string
+	upstreams *upstreams
+}
+
+// Creates the upstreams of the forwarding rules, longest domain first so that
+// the most specific rule matches.
+func (s *DNSServer) createForwardRules(rules []ForwardRule) {
+	for _, rule := range rules {
+		s.rules = append(s.rules, &forwardRule{
+			domain:    rule.Domain,
+			upstreams: newUpstreams(s.filterOwnAddresses(rule.Nameservers), s.config.forwardStrategy),
+		})
+	}
+	sort.SliceStable(s.rules, func(i, j int) bool {
+		return dns.CountLabel(s.rules[i].domain) > dns.CountLabel(s.rules[j].domain)
+	})
+}
+
+// Returns the nameservers for the name and the domain of the rule which
+// picked them, "." for the default nameservers.
+func (s *DNSServer) getUpstreams(name string) (*upstreams, string) {
+	for _, rule := range s.rules {
+		if dns.IsSubDomain(rule.domain, dns.Fqdn(name)) {
+			return rule.upstreams, rule.domain
+		}
+	}
+	return s.upstreams, "."
+}
+
+// Forwards the request to the nameservers of the most specific rule, or
+// answers it from the cache.
+func (s *DNSServer) exchange(r *dns.Msg, network string) (*dns.Msg, error) {
+	upstreams, rule := s.getUpstreams(r.Question[0].Name)
+	if s.config.debug {
+		log.Println("Forwarding", r.Question[0].Name, "by rule", rule)
+	}
+	if s.cache == nil {
+		return upstreams.exchange(r, network)
+	}
+	return s.cache.exchange(r, network, func() (*dns.Msg, error) {
+		return upstreams.exchange(r, network)
+	})
+}
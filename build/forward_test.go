@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestGetUpstreams(t *testing.T) {
+	config := NewConfig()
+	config.nameservers = []string{"10.0.0.1:53"}
+	config.resolvConf = ""
+	config.forwardRules = []ForwardRule{
+		{"example.com.", []string{"10.0.0.2:53"}},
+		{"corp.example.com.", []string{"10.0.0.3:53"}},
+	}
+	s := NewDNSServer(config)
+
+	inputs := map[string]string{
+		"www.example.org.":       ".",
+		"example.com.":           "example.com.",
+		"www.example.com.":       "example.com.",
+		"notcorp.example.com.":   "example.com.",
+		"corp.example.com.":      "corp.example.com.",
+		"host.CORP.example.com.": "corp.example.com.",
+		"a.b.corp.example.com":   "corp.example.com.",
+		"www.example.com.evil.":  ".",
+	}
+	for name, expected := range inputs {
+		if _, rule := s.getUpstreams(name); rule != expected {
+			t.Error(name, "Expected rule:", expected, "Got:", rule)
+		}
+	}
+}
+
+func TestForwardRules(t *testing.T) {
+	const (
+		TEST_ADDR    = "127.0.0.1:9971"
+		DEFAULT_ADDR = "127.0.0.1:9972"
+		CORP_ADDR    = "127.0.0.1:9973"
+	)
+
+	def := startUpstream(DEFAULT_ADDR, net.ParseIP("10.0.0.1"), dns.RcodeSuccess)
+	defer def.Shutdown()
+	corp := startUpstream(CORP_ADDR, net.ParseIP("10.8.0.1"), dns.RcodeSuccess)
+	defer corp.Shutdown()
+
+	config := NewConfig()
+	config.dnsAddr = TEST_ADDR
+	config.nameservers = []string{DEFAULT_ADDR}
+	config.resolvConf = ""
+	config.forwardRules = []ForwardRule{{"corp.example.com.", []string{CORP_ADDR}}}
+
+	server := NewDNSServer(config)
+	go server.Start()
+	defer server.Stop()
+
+	// Allow some time for servers to start
+	time.Sleep(250 * time.Millisecond)
+
+	inputs := map[string]string{
+		"www.example.com.":       "10.0.0.1",
+		"host.corp.example.com.": "10.8.0.1",
+	}
+	for name, expected := range inputs {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		in, _, err := new(dns.Client).Exchange(m, TEST_ADDR)
+		if err != nil {
+			t.Fatal("Error response from the server", err)
+		}
+		if len(in.Answer) != 1 || in.Answer[0].(*dns.A).A.String() != expected {
+			t.Error(name, "Expected:", expected, "Got:", in.Answer)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+)
+
+// Health states of containers with HEALTHCHECK, as Docker reports them.
+const (
+	healthStarting  = "starting"
+	healthHealthy   = "healthy"
+	healthUnhealthy = "unhealthy"
+)
+
+// Returns the health from the container status shown by docker ps, e.g.
+// "Up 2 minutes (unhealthy)" or "Up 3 seconds (health: starting)". Empty
+// string means the container has no healthcheck.
+func parseHealth(status string) string {
+	start := strings.LastIndex(status, "(")
+	if start == -1 || !strings.HasSuffix(status, ")") {
+		return ""
+	}
+	health := strings.TrimPrefix(status[start+1:len(status)-1], "health: ")
+	switch health {
+	case healthStarting, healthHealthy, healthUnhealthy:
+		return health
+	}
+	return ""
+}
+
+// Containers without healthcheck, with passing healthcheck or opted out of
+// health checking get the traffic. Containers which are still starting don't.
+func isHealthy(s *Service) bool {
+	return s.IgnoreHealth || s.Health == "" || s.Health == healthHealthy
+}
+
+// Returns the healthy services, or all of them if none is healthy. Sending
+// clients to failing containers is still better than no answer at all.
+func filterHealthy(services []*Service) []*Service {
+	var healthy []*Service
+	for _, service := range services {
+		if isHealthy(service) {
+			healthy = append(healthy, service)
+		}
+	}
+	if len(healthy) == 0 {
+		return services
+	}
+	return healthy
+}
+
+// Returns the services matching the query as slice.
+func (s *DNSServer) getServices(query string) (services []*Service) {
+	for service := range s.queryServices(query) {
+		services = append(services, service)
+	}
+	return
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseHealth(t *testing.T) {
+	inputs := map[string]string{
+		"Up 2 minutes":                    "",
+		"Up 2 minutes (healthy)":          healthHealthy,
+		"Up 2 minutes (unhealthy)":        healthUnhealthy,
+		"Up 3 seconds (health: starting)": healthStarting,
+		"Up 2 minutes (Paused)":           "",
+		"Exited (0) 5 seconds ago":        "",
+	}
+
+	for status, expected := range inputs {
+		if actual := parseHealth(status); actual != expected {
+			t.Error(status, "Expected:", expected, "Got:", actual)
+		}
+	}
+}
+
+func TestHealthyAnswers(t *testing.T) {
+	s := NewDNSServer(NewConfig())
+
+	s.AddService("web1", Service{Name: "web1", Image: "myapp", Ip: net.ParseIP("172.17.0.1"), Ttl: -1, Alias: "www.example.com", Health: healthHealthy})
+	s.AddService("web2", Service{Name: "web2", Image: "myapp", Ip: net.ParseIP("172.17.0.2"), Ttl: -1, Alias: "www.example.com", Health: healthUnhealthy})
+	s.AddService("web3", Service{Name: "web3", Image: "myapp", Ip: net.ParseIP("172.17.0.3"), Ttl: -1, Alias: "www.example.com", Health: healthStarting})
+	s.AddService("web4", Service{Name: "web4", Image: "myapp", Ip: net.ParseIP("172.17.0.4"), Ttl: -1, Alias: "www.example.com"})
+	s.AddService("web5", Service{Name: "web5", Image: "myapp", Ip: net.ParseIP("172.17.0.5"), Ttl: -1, Alias: "www.example.com", Health: healthUnhealthy, IgnoreHealth: true})
+	s.AddService("db1", Service{Name: "db1", Image: "db", Ip: net.ParseIP("172.17.0.6"), Ttl: -1, Health: healthUnhealthy})
+	s.AddService("db2", Service{Name: "db2", Image: "db", Ip: net.ParseIP("172.17.0.7"), Ttl: -1, Health: healthStarting})
+
+	inputs := []struct {
+		query    string
+		expected int
+	}{
+		// web2 and web3 are left out
+		{"myapp.docker", 3},
+		{"www.example.com", 3},
+		// the unhealthy container itself is still answered when asked for
+		{"web2.myapp.docker", 1},
+		// no healthy db, all of them are returned
+		{"db.docker", 2},
+	}
+
+	for _, input := range inputs {
+		a := s.resolve(input.query, dns.TypeA, input.query+".", 0)
+		if len(a.Answer) != input.expected {
+			t.Error(input.query, "Expected:", input.expected, "Got:", a.Answer)
+		}
+		for _, rr := range a.Answer {
+			if ip := rr.(*dns.A).A.String(); input.expected == 3 && (ip == "172.17.0.2" || ip == "172.17.0.3") {
+				t.Error(input.query, "Unhealthy container in answer", ip)
+			}
+		}
+	}
+}
+
+func TestSetHealth(t *testing.T) {
+	config := NewConfig()
+	config.allowTransfer, _ = ParseNetworks("127.0.0.1")
+	s := NewDNSServer(config)
+
+	s.AddService("web1", Service{Name: "web1", Image: "myapp", Ip: net.ParseIP("172.17.0.1"), Ttl: -1, Health: healthHealthy})
+	s.AddService("web2", Service{Name: "web2", Image: "myapp", Ip: net.ParseIP("172.17.0.2"), Ttl: -1, Health: healthHealthy})
+	serial := s.getSerial()
+	journal := len(s.journal)
+
+	if err := s.SetHealth("web2", healthUnhealthy); err != nil {
+		t.Fatal(err)
+	}
+	if a := s.resolve("myapp.docker", dns.TypeA, "myapp.docker.", 0); len(a.Answer) != 1 {
+		t.Error("Expected only the healthy container, Got:", a.Answer)
+	}
+	// The zone records are the same, secondaries have nothing to transfer.
+	if s.getSerial() != serial || len(s.journal) != journal {
+		t.Error("Health change shouldn't change the serial, Got:", s.getSerial(), "journal:", s.journal[journal:])
+	}
+
+	if err := s.SetHealth("missing", healthHealthy); err == nil {
+		t.Error("Health of unknown container should fail")
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+)
+
+// Maximum number of changes kept in the journal. Older changes are dropped
+// and IXFR requests reaching beyond them get the full zone.
+const journalSize = 1000
+
+// journalEntry records how the zone changed from serial From to serial To.
+type journalEntry struct {
+	From    uint32
+	To      uint32
+	Removed []dns.RR
+	Added   []dns.RR
+}
+
+// The journal is kept only when somebody is allowed to transfer the zone.
+func (s *DNSServer) isJournaling() bool {
+	return len(s.config.allowTransfer) > 0
+}
+
+// Returns the zone records to compare with after a change, or nil when the
+// journal is not kept. Caller must hold the lock.
+func (s *DNSServer) getJournalSnapshot() []dns.RR {
+	if !s.isJournaling() {
+		return nil
+	}
+	return s.getZoneRecords()
+}
+
+// Bumps the serial after the zone was changed and journals the difference
+// against the records from before the change. Caller must hold the lock.
+func (s *DNSServer) commitChange(before []dns.RR) {
+	from := s.getSerial()
+	s.bumpSerial()
+
+	if before == nil {
+		return
+	}
+
+	removed, added := diffRecords(before, s.getZoneRecords())
+	s.journal = append(s.journal, journalEntry{
+		From:    from,
+		To:      s.getSerial(),
+		Removed: removed,
+		Added:   added,
+	})
+	if len(s.journal) > journalSize {
+		s.journal = s.journal[len(s.journal)-journalSize:]
+	}
+}
+
+// Returns the journal entries since the serial. ok is false if the journal
+// doesn't reach back that far.
+func (s *DNSServer) getJournalSince(serial uint32) (entries []journalEntry, ok bool) {
+	for i, entry := range s.journal {
+		if entry.From == serial {
+			return s.journal[i:], true
+		}
+	}
+	return nil, false
+}
+
+// Compares two sets of records, returns records only in before and records
+// only in after.
+func diffRecords(before, after []dns.RR) (removed, added []dns.RR) {
+	in_before := make(map[string]struct{}, len(before))
+	for _, rr := range before {
+		in_before[rr.String()] = struct{}{}
+	}
+	in_after := make(map[string]struct{}, len(after))
+	for _, rr := range after {
+		in_after[rr.String()] = struct{}{}
+		if _, ok := in_before[rr.String()]; !ok {
+			added = append(added, rr)
+		}
+	}
+	for _, rr := range before {
+		if _, ok := in_after[rr.String()]; !ok {
+			removed = append(removed, rr)
+		}
+	}
+	return
+}
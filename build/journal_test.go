@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestDiffRecords(t *testing.T) {
+	rr := func(s string) dns.RR {
+		r, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	before := []dns.RR{rr("a.docker. 0 IN A 10.0.0.1"), rr("b.docker. 0 IN A 10.0.0.2")}
+	after := []dns.RR{rr("b.docker. 0 IN A 10.0.0.2"), rr("c.docker. 0 IN A 10.0.0.3")}
+
+	removed, added := diffRecords(before, after)
+	if len(removed) != 1 || removed[0].Header().Name != "a.docker." {
+		t.Error("Expected a.docker. removed, got", removed)
+	}
+	if len(added) != 1 || added[0].Header().Name != "c.docker." {
+		t.Error("Expected c.docker. added, got", added)
+	}
+}
+
+func TestJournal(t *testing.T) {
+	config := NewConfig()
+	s := NewDNSServer(config)
+
+	s.AddService("foo", Service{Name: "foo", Image: "bar", Ip: net.ParseIP("172.17.0.2"), Ttl: -1})
+	if len(s.journal) != 0 {
+		t.Error("Journal should not be kept when transfers are not allowed")
+	}
+
+	config.allowTransfer, _ = ParseNetworks("127.0.0.1")
+	serial := s.getSerial()
+
+	s.AddService("baz", Service{Name: "baz", Image: "bar", Ip: net.ParseIP("172.17.0.3"), Ttl: -1})
+	s.RemoveService("foo")
+
+	entries, ok := s.getJournalSince(serial)
+	if !ok || len(entries) != 2 {
+		t.Fatal("Expected two journal entries, got", entries)
+	}
+	if entries[0].From != serial || entries[1].To != s.getSerial() {
+		t.Error("Journal serials don't match", entries)
+	}
+	// A and TXT records of the container and of the wildcard below it, A
+	// records of the apex and of the image name. Their TXT records have the
+	// same (empty) metadata as the other container.
+	if len(entries[0].Added) != 6 || len(entries[0].Removed) != 0 {
+		t.Error("Invalid first entry", entries[0])
+	}
+	if len(entries[1].Added) != 0 || len(entries[1].Removed) != 6 {
+		t.Error("Invalid second entry", entries[1])
+	}
+
+	if _, ok := s.getJournalSince(serial - 1); ok {
+		t.Error("Journal should not reach before it was started")
+	}
+
+	for i := 0; i < journalSize+10; i++ {
+		s.AddService("baz", Service{Name: "baz", Image: "bar", Ip: net.IPv4(172, 17, byte(i/250), byte(i%250+2)), Ttl: -1})
+	}
+	if len(s.journal) != journalSize {
+		t.Error("Journal should be bounded, has", len(s.journal))
+	}
+}
+
+func TestIncrementalTransfer(t *testing.T) {
+	const TEST_ADDR = "127.0.0.1:9960"
+
+	config := NewConfig()
+	config.dnsAddr = TEST_ADDR
+	config.allowTransfer, _ = ParseNetworks("127.0.0.0/8")
+
+	server := NewDNSServer(config)
+	go server.Start()
+
+	// Allow some time for server to start
+	time.Sleep(250 * time.Millisecond)
+
+	server.AddService("foo", Service{Name: "foo", Image: "bar", Ip: net.ParseIP("172.17.0.2"), Ttl: -1})
+	serial := server.getSerial()
+	server.AddService("baz", Service{Name: "baz", Image: "bar", Ip: net.ParseIP("172.17.0.3"), Ttl: -1})
+	server.RemoveService("foo")
+
+	transfer := func(serial uint32) (records []dns.RR) {
+		m := new(dns.Msg)
+		m.SetIxfr("docker.", serial, "master.docker.", "hostmaster.docker.")
+		envelopes, err := new(dns.Transfer).In(m, TEST_ADDR)
+		if err != nil {
+			t.Fatal("Transfer failed", err)
+		}
+		for envelope := range envelopes {
+			if envelope.Error != nil {
+				t.Fatal("Transfer failed", envelope.Error)
+			}
+			records = append(records, envelope.RR...)
+		}
+		return records
+	}
+
+	// SOA, (SOA, SOA, 6 added), (SOA, 6 removed, SOA), SOA, see TestJournal
+	records := transfer(serial)
+	if len(records) != 18 {
+		t.Error("Expected incremental transfer of 18 records, got", records)
+	}
+
+	// Up to date client gets just the SOA
+	records = transfer(server.getSerial())
+	if len(records) != 1 {
+		t.Error("Expected single SOA, got", records)
+	}
+
+	// Journal doesn't reach, full zone: SOA, NS, A and TXT of the container,
+	// its wildcard, the image name and the apex, SOA
+	records = transfer(serial - 10)
+	if len(records) != 11 {
+		t.Error("Expected full zone, got", records)
+	}
+}
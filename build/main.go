@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 )
 
 var version string
@@ -14,10 +15,28 @@ func main() {
 
 	config := NewConfig()
 
-	flag.StringVar(&config.nameserver, "nameserver", config.nameserver, "DNS server for unmatched requests")
+	nameservers := flag.String("nameserver", resolvConfNameserver, "Comma separated DNS servers for unmatched requests, or resolv.conf for the nameservers from -resolv-conf")
+	flag.StringVar(&config.resolvConf, "resolv-conf", config.resolvConf, "resolv.conf with nameservers, search domains and options, watched for changes")
+	flag.BoolVar(&config.search, "search", false, "Retry short names which the nameservers don't find with the search domains from -resolv-conf, answering with an unsigned CNAME")
+	forwardRules := flag.String("forward-rules", "", "Nameservers for domains, e.g. corp.example.com=10.8.0.1,10.8.0.2;consul=127.0.0.1:8600")
+	forwardRulesFile := flag.String("forward-rules-file", "", "File with forward rules, one \"domain nameserver...\" per line")
+	forward := flag.String("forward", config.forwardStrategy, "How to use more nameservers: sequential (in order until one answers) or parallel (first answer wins)")
 	flag.StringVar(&config.dnsAddr, "dns", config.dnsAddr, "Listen DNS requests on this address")
 	domain := flag.String("domain", config.domain.String(), "Domain that is appended to all requests")
 	environment := flag.String("environment", "", "Optional context before domain suffix")
+	flag.StringVar(&config.nsName, "ns-name", config.nsName, "Host name of this server in SOA and NS records of the domain (default master.<domain>)")
+	flag.StringVar(&config.nsAddr, "ns-ip", config.nsAddr, "IP address of this server, used as glue for the NS record")
+	allowTransfer := flag.String("allow-transfer", "", "Comma separated networks allowed to transfer the zone (AXFR and IXFR), e.g. 10.0.0.0/8")
+	notify := flag.String("notify", "", "Comma separated secondary servers to NOTIFY when the zone changes")
+	tsigKeys := flag.String("tsig-key", "", "Comma separated TSIG keys (name:base64secret) allowed to send dynamic updates")
+	flag.BoolVar(&config.txt, "txt", config.txt, "Publish container metadata in TXT records")
+	txtLabels := flag.String("txt-labels", "", "Comma separated Docker labels published in TXT records")
+	flag.IntVar(&config.maxUDPSize, "max-udp-size", config.maxUDPSize, "Maximum size of UDP replies to clients advertising bigger EDNS0 buffer")
+	flag.BoolVar(&config.minimalAny, "minimal-any", false, "Answer ANY queries with a single RRset (RFC 8482), for servers reachable from untrusted networks")
+	order := flag.String("order", config.order, "Order of the answers for names of more containers: random, round-robin or weighted (by DNSDOCK_WEIGHT)")
+	flag.IntVar(&config.cacheSize, "cache-size", config.cacheSize, "Maximum number of cached forwarded responses, 0 disables the cache")
+	flag.IntVar(&config.maxAnswers, "max-answers", 0, "Maximum number of address records in an answer, 0 for no limit")
+	flag.StringVar(&config.dnssecKeys, "dnssec-keys", "", "Directory with DNSSEC keys of the domain, generated if missing. Enables signing")
 	flag.StringVar(&config.dockerHost, "docker", config.dockerHost, "Path to the docker socket")
 	flag.BoolVar(&config.verbose, "verbose", true, "Verbose output")
 	flag.BoolVar(&config.debug, "debug", false, "See coming queries")
@@ -43,7 +62,54 @@ func main() {
 
 	config.domain = NewDomain(*environment + "." + *domain)
 
+	networks, err := ParseNetworks(*allowTransfer)
+	if err != nil {
+		log.Fatal(err)
+	}
+	config.allowTransfer = networks
+	config.notify = ParseAddresses(*notify)
+
+	if config.tsigKeys, err = ParseTsigKeys(*tsigKeys); err != nil {
+		log.Fatal(err)
+	}
+
+	if *nameservers != resolvConfNameserver {
+		if config.nameservers = ParseAddresses(*nameservers); len(config.nameservers) == 0 {
+			log.Fatal("No nameserver given")
+		}
+		config.resolvConf = ""
+	}
+	if config.forwardStrategy, err = ParseForwardStrategy(*forward); err != nil {
+		log.Fatal(err)
+	}
+
+	if config.forwardRules, err = ParseForwardRules(*forwardRules); err != nil {
+		log.Fatal(err)
+	}
+	if *forwardRulesFile != "" {
+		rules, err := ReadForwardRules(*forwardRulesFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.forwardRules = append(config.forwardRules, rules...)
+	}
+
+	if config.order, err = ParseOrder(*order); err != nil {
+		log.Fatal(err)
+	}
+
+	for _, label := range strings.Split(*txtLabels, ",") {
+		if label = strings.TrimSpace(label); label != "" {
+			config.txtLabels = append(config.txtLabels, label)
+		}
+	}
+
 	dnsServer := NewDNSServer(config)
+	if config.dnssecKeys != "" {
+		if err := dnsServer.LoadKeys(config.dnssecKeys); err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	docker, err := NewDockerManager(config, dnsServer)
 	if err != nil {
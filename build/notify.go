@@ -0,0 +1,80 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Time to wait after a change of the zone before secondaries are notified.
+// Changes in this window (e.g. docker-compose starting many containers) are
+// sent out as a single NOTIFY.
+const notifyDelay = time.Second
+
+// Number of NOTIFY attempts per secondary, RFC 1996 wants them retried until
+// they're answered.
+const notifyAttempts = 3
+
+// Signals the notifier that the zone changed. Never blocks, pending signal
+// already covers the new change.
+func (s *DNSServer) zoneChanged() {
+	select {
+	case s.notifyCh <- struct{}{}:
+	default:
+	}
+}
+
+// Sends NOTIFY to the configured secondaries whenever the zone changes, until
+// the done channel is closed.
+func (s *DNSServer) runNotifier(done chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-s.notifyCh:
+		}
+
+		// Let the burst of changes settle.
+		select {
+		case <-done:
+			return
+		case <-time.After(s.notifyDelay):
+		}
+		// Changes made during the delay are covered by this NOTIFY.
+		select {
+		case <-s.notifyCh:
+		default:
+		}
+
+		s.sendNotify()
+	}
+}
+
+func (s *DNSServer) sendNotify() {
+	soa := s.createSOA()
+	for _, secondary := range s.config.notify {
+		go func(secondary string) {
+			m := new(dns.Msg)
+			m.SetNotify(dns.Fqdn(s.config.domain.String()))
+			m.Authoritative = true
+			m.Answer = soa
+
+			c := new(dns.Client)
+			for i := 0; i < notifyAttempts; i++ {
+				in, _, err := c.Exchange(m, secondary)
+				if err == nil && in.Rcode == dns.RcodeSuccess {
+					if s.config.verbose {
+						log.Println("Notified", secondary, "about serial", soa[0].(*dns.SOA).Serial)
+					}
+					return
+				}
+				if err == nil {
+					log.Println("NOTIFY to", secondary, "answered with", dns.RcodeToString[in.Rcode])
+					return
+				}
+				log.Println("NOTIFY to", secondary, "failed:", err)
+			}
+		}(secondary)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestNotify(t *testing.T) {
+	const SECONDARY_ADDR = "127.0.0.1:9958"
+
+	var notifies int32
+	var serial uint32
+	secondary := &dns.Server{Addr: SECONDARY_ADDR, Net: "udp", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		if r.Opcode == dns.OpcodeNotify {
+			atomic.AddInt32(&notifies, 1)
+			if len(r.Answer) == 1 {
+				atomic.StoreUint32(&serial, r.Answer[0].(*dns.SOA).Serial)
+			}
+		}
+		m := new(dns.Msg)
+		m.SetReply(r)
+		w.WriteMsg(m)
+	})}
+	go secondary.ListenAndServe()
+	defer secondary.Shutdown()
+
+	config := NewConfig()
+	config.dnsAddr = "127.0.0.1:9959"
+	config.notify = []string{SECONDARY_ADDR}
+
+	server := NewDNSServer(config)
+	server.notifyDelay = 100 * time.Millisecond
+	go server.Start()
+	defer server.Stop()
+
+	// Allow some time for servers to start
+	time.Sleep(250 * time.Millisecond)
+
+	for i := 0; i < 20; i++ {
+		server.AddService(string('a'+byte(i)), Service{Name: "web", Image: "bar", Ip: net.ParseIP("127.0.0.1"), Ttl: -1})
+	}
+
+	time.Sleep(500 * time.Millisecond)
+
+	if n := atomic.LoadInt32(&notifies); n != 1 {
+		t.Error("Burst of changes should be sent as one NOTIFY, got", n)
+	}
+	if actual := atomic.LoadUint32(&serial); actual != server.getSerial() {
+		t.Error("NOTIFY should carry the latest serial. Expected:", server.getSerial(), "Got:", actual)
+	}
+
+	server.RemoveService("a")
+	time.Sleep(500 * time.Millisecond)
+
+	if n := atomic.LoadInt32(&notifies); n != 2 {
+		t.Error("Expected second NOTIFY, got", n)
+	}
+}
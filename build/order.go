@@ -0,0 +1,99 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Strategies for ordering the address records of names shared by more
+// containers.
+const (
+	orderRandom     = "random"
+	orderRoundRobin = "round-robin"
+	orderWeighted   = "weighted"
+)
+
+// Maximum number of names with round-robin state. The state is dropped when
+// there are more, so that queries for made up names can't eat the memory.
+const maxRotations = 10000
+
+// Address record of a service, with the weight of the service.
+type weightedRecord struct {
+	rr     dns.RR
+	weight int
+}
+
+func getServiceWeight(s *Service) int {
+	if s.Weight <= 0 {
+		return 1
+	}
+	return s.Weight
+}
+
+// Orders the address records for the name by the configured strategy, and
+// cuts them to the configured maximum:
+//   - random shuffles the records for every answer
+//   - round-robin rotates the records by one with every answer for the name,
+//     lookups without rotate get the current order
+//   - weighted picks the records at random, services with bigger weight are
+//     more likely to come first
+func (s *DNSServer) orderRecords(name string, qtype uint16, records []weightedRecord, rotate bool) (out []dns.RR) {
+	// Start from the same order every time, map iteration order is random
+	// and would mess up the rotation.
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].rr.String() < records[j].rr.String()
+	})
+
+	switch s.config.order {
+	case orderRoundRobin:
+		n := len(records)
+		if n > 0 {
+			shift := int(s.getRotation(name, qtype, rotate) % uint64(n))
+			records = append(records[shift:], records[:shift]...)
+		}
+	case orderWeighted:
+		// Weighted random sampling without replacement (Efraimidis and
+		// Spirakis): sort by u^(1/w) for random u in (0, 1).
+		keys := make(map[dns.RR]float64, len(records))
+		for _, record := range records {
+			keys[record.rr] = math.Pow(1-rand.Float64(), 1/float64(record.weight))
+		}
+		sort.SliceStable(records, func(i, j int) bool {
+			return keys[records[i].rr] > keys[records[j].rr]
+		})
+	default:
+		rand.Shuffle(len(records), func(i, j int) {
+			records[i], records[j] = records[j], records[i]
+		})
+	}
+
+	for _, record := range records {
+		out = append(out, record.rr)
+	}
+	if s.config.maxAnswers > 0 && len(out) > s.config.maxAnswers {
+		out = out[:s.config.maxAnswers]
+	}
+	return
+}
+
+// Returns the number of previous answers for the name and type, for the
+// round-robin ordering. The answer is counted if rotate is set.
+func (s *DNSServer) getRotation(name string, qtype uint16, rotate bool) uint64 {
+	defer s.rotationLock.Unlock()
+	s.rotationLock.Lock()
+
+	key := strings.ToLower(name) + "/" + dns.TypeToString[qtype]
+	n, ok := s.rotations[key]
+	if !rotate {
+		return n
+	}
+	if !ok && len(s.rotations) >= maxRotations {
+		s.rotations = make(map[string]uint64)
+	}
+	s.rotations[key] = n + 1
+	return n
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func getAddresses(rrs []dns.RR) (out []string) {
+	for _, rr := range rrs {
+		out = append(out, rr.(*dns.A).A.String())
+	}
+	return
+}
+
+func TestRoundRobin(t *testing.T) {
+	config := NewConfig()
+	config.order = orderRoundRobin
+	s := NewDNSServer(config)
+
+	for i := 1; i <= 3; i++ {
+		id := strconv.Itoa(i)
+		s.AddService(id, Service{Name: "web" + id, Image: "myapp", Ip: net.ParseIP("172.17.0." + id), Ttl: -1, Alias: "www.example.com"})
+	}
+
+	for _, query := range []string{"myapp.docker", "www.example.com"} {
+		firsts := make(map[string]int)
+		for i := 0; i < 6; i++ {
+			a := s.resolve(query, dns.TypeA, query+".", 0)
+			addrs := getAddresses(a.Answer)
+			if len(addrs) != 3 {
+				t.Fatal(query, "Expected: 3 Got:", addrs)
+			}
+			firsts[addrs[0]]++
+		}
+		// Every container is first twice in six answers
+		for _, ip := range []string{"172.17.0.1", "172.17.0.2", "172.17.0.3"} {
+			if firsts[ip] != 2 {
+				t.Error(query, ip, "Expected first: 2 Got:", firsts[ip])
+			}
+		}
+	}
+}
+
+func TestRoundRobinOtherLookups(t *testing.T) {
+	config := NewConfig()
+	config.order = orderRoundRobin
+	s := NewDNSServer(config)
+
+	for i := 1; i <= 3; i++ {
+		id := strconv.Itoa(i)
+		s.AddService(id, Service{Name: "web" + id, Image: "myapp", Ip: net.ParseIP("172.17.0." + id), Ttl: -1})
+	}
+
+	var firsts []string
+	for i := 0; i < 3; i++ {
+		a := s.resolve("myapp.docker", dns.TypeA, "myapp.docker.", 0)
+		firsts = append(firsts, getAddresses(a.Answer)[0])
+
+		// Lookups which don't answer with the addresses don't rotate them.
+		s.resolve("myapp.docker", dns.TypeANY, "myapp.docker.", 0)
+		s.createNoDataNSEC("myapp.docker", "myapp.docker.")
+		chaos := new(dns.Msg)
+		chaos.SetQuestion("myapp.docker.", dns.TypeA)
+		chaos.Question[0].Qclass = dns.ClassCHAOS
+		s.checkRequest(chaos)
+	}
+	if firsts[0] == firsts[1] || firsts[1] == firsts[2] || firsts[0] == firsts[2] {
+		t.Error("Every container should be first once, Got:", firsts)
+	}
+}
+
+func TestMaxAnswers(t *testing.T) {
+	config := NewConfig()
+	config.maxAnswers = 2
+	s := NewDNSServer(config)
+
+	for i := 1; i <= 5; i++ {
+		id := strconv.Itoa(i)
+		s.AddService(id, Service{Name: "web" + id, Image: "myapp", Ip: net.ParseIP("172.17.0." + id), Ttl: -1})
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		a := s.resolve("myapp.docker", dns.TypeA, "myapp.docker.", 0)
+		if len(a.Answer) != 2 {
+			t.Fatal("Expected: 2 Got:", len(a.Answer))
+		}
+		for _, ip := range getAddresses(a.Answer) {
+			seen[ip] = true
+		}
+	}
+	// Shuffled before cutting, so all the containers get some traffic
+	if len(seen) != 5 {
+		t.Error("Expected all 5 containers in the answers, Got:", seen)
+	}
+}
+
+func TestWeightedOrder(t *testing.T) {
+	config := NewConfig()
+	config.order = orderWeighted
+	config.maxAnswers = 1
+	s := NewDNSServer(config)
+
+	s.AddService("heavy", Service{Name: "heavy", Image: "myapp", Ip: net.ParseIP("172.17.0.1"), Ttl: -1, Weight: 9})
+	s.AddService("light", Service{Name: "light", Image: "myapp", Ip: net.ParseIP("172.17.0.2"), Ttl: -1})
+
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		a := s.resolve("myapp.docker", dns.TypeA, "myapp.docker.", 0)
+		counts[getAddresses(a.Answer)[0]]++
+	}
+	// 900 expected, far from the 500 of uniform order
+	if counts["172.17.0.1"] < 800 || counts["172.17.0.2"] == 0 {
+		t.Error("Expected about 900:100, Got:", counts)
+	}
+}
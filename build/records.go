@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Record types which containers can declare with DNSDOCK_RECORD_* variables
+// or dnsdock.record.* labels.
+var declarableTypes = map[string]uint16{
+	"MX":  dns.TypeMX,
+	"TXT": dns.TypeTXT,
+	"SRV": dns.TypeSRV,
+	"CAA": dns.TypeCAA,
+}
+
+// Returns the record declarations of the container from the environment
+// (DNSDOCK_RECORD_<n>) and labels (dnsdock.record.<n>), keyed by the
+// variable or label name.
+func getRecordDeclarations(env map[string]string, labels map[string]string) map[string]string {
+	out := make(map[string]string)
+	for k, v := range env {
+		if strings.HasPrefix(k, "DNSDOCK_RECORD_") {
+			out[k] = v
+		}
+	}
+	for k, v := range labels {
+		if strings.HasPrefix(k, "dnsdock.record.") {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// Parses record declaration in the "[owner] TYPE rdata" form, e.g. "MX 10
+// mail" or "_dmarc TXT v=DMARC1; p=none". The owner defaults to the canonical
+// name of the container. Relative names are relative to the domain. The
+// owner must be inside the domain.
+func parseRecordDeclaration(declaration string, owner string, domain Domain, ttl int) (dns.RR, error) {
+	fields := strings.Fields(declaration)
+	if len(fields) == 0 {
+		return nil, errors.New("empty declaration")
+	}
+	if _, isType := declarableTypes[strings.ToUpper(fields[0])]; !isType {
+		owner = fields[0]
+		fields = fields[1:]
+	}
+	if len(fields) < 2 {
+		return nil, errors.New("expected [owner] TYPE rdata")
+	}
+	rrtype, ok := declarableTypes[strings.ToUpper(fields[0])]
+	if !ok {
+		return nil, errors.New("record type " + fields[0] + " can't be declared")
+	}
+
+	origin := dns.Fqdn(domain.String())
+	rdata := strings.Join(fields[1:], " ")
+	if rrtype == dns.TypeTXT && !strings.HasPrefix(rdata, "\"") {
+		// Most TXT records are single string, spare people the quoting.
+		rdata = strconv.Quote(rdata)
+	}
+
+	zp := dns.NewZoneParser(strings.NewReader(owner+" "+strconv.Itoa(ttl)+" IN "+dns.TypeToString[rrtype]+" "+rdata), origin, "")
+	rr, ok := zp.Next()
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	if !ok || rr == nil {
+		return nil, errors.New("no record in declaration")
+	}
+
+	rr.Header().Name = strings.ToLower(rr.Header().Name)
+	if !dns.IsSubDomain(origin, rr.Header().Name) {
+		return nil, errors.New(rr.Header().Name + " is outside of domain " + origin)
+	}
+	return rr, nil
+}
+
+// Parses all the declarations, invalid ones are returned as errors keyed by
+// the variable or label name. Records are in the order of the keys.
+func parseRecordDeclarations(declarations map[string]string, owner string, domain Domain, ttl int) (records []dns.RR, errs map[string]error) {
+	keys := make([]string, 0, len(declarations))
+	for k := range declarations {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	errs = make(map[string]error)
+	for _, k := range keys {
+		rr, err := parseRecordDeclaration(declarations[k], owner, domain, ttl)
+		if err != nil {
+			errs[k] = err
+			continue
+		}
+		records = append(records, rr)
+	}
+	return
+}
+
+// Returns the records declared by the containers with the owner name equal to
+// the query, renamed to qname. exists is true if any declared record has that
+// owner.
+func (s *DNSServer) getDeclaredRecords(query string, qtype uint16, qname string) (records []dns.RR, exists bool) {
+	defer s.lock.RUnlock()
+	s.lock.RLock()
+
+	name := dns.Fqdn(strings.ToLower(query))
+	for _, service := range s.services {
+		for _, rr := range service.Records {
+			if rr.Header().Name != name {
+				continue
+			}
+			exists = true
+			if rr.Header().Rrtype == qtype {
+				rr = dns.Copy(rr)
+				rr.Header().Name = qname
+				records = append(records, rr)
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestGetRecordDeclarations(t *testing.T) {
+	env := map[string]string{"DNSDOCK_RECORD_1": "MX 10 mail", "DNSDOCK_NAME": "web"}
+	labels := map[string]string{"dnsdock.record.spf": "TXT v=spf1 -all", "team": "ops"}
+	expected := map[string]string{"DNSDOCK_RECORD_1": "MX 10 mail", "dnsdock.record.spf": "TXT v=spf1 -all"}
+	if actual := getRecordDeclarations(env, labels); !reflect.DeepEqual(actual, expected) {
+		t.Error("Expected:", expected, "Got:", actual)
+	}
+}
+
+func TestParseRecordDeclaration(t *testing.T) {
+	domain := NewDomain("docker")
+	owner := "mail.postfix.docker."
+
+	inputs := []struct {
+		declaration string
+		expected    string
+	}{
+		{"MX 10 mail", "mail.postfix.docker.\t60\tIN\tMX\t10 mail.docker."},
+		{"mx 10 mail.example.com.", "mail.postfix.docker.\t60\tIN\tMX\t10 mail.example.com."},
+		{"TXT v=spf1 mx -all", "mail.postfix.docker.\t60\tIN\tTXT\t\"v=spf1 mx -all\""},
+		{"_dmarc TXT \"v=DMARC1; p=none\"", "_dmarc.docker.\t60\tIN\tTXT\t\"v=DMARC1; p=none\""},
+		{"Test.Docker. TXT token", "test.docker.\t60\tIN\tTXT\t\"token\""},
+		{"SRV 0 0 25 mail", "mail.postfix.docker.\t60\tIN\tSRV\t0 0 25 mail.docker."},
+	}
+
+	for _, input := range inputs {
+		t.Log(input.declaration)
+		rr, err := parseRecordDeclaration(input.declaration, owner, domain, 60)
+		if err != nil {
+			t.Error(input.declaration, "failed:", err)
+			continue
+		}
+		if actual := rr.String(); actual != input.expected {
+			t.Error(input.declaration, "Expected:", input.expected, "Got:", actual)
+		}
+	}
+
+	for _, declaration := range []string{
+		"",
+		"MX",
+		"A 10.0.0.1",
+		"NS ns.example.com.",
+		"MX ten mail",
+		"www.example.com. TXT outside",
+	} {
+		if rr, err := parseRecordDeclaration(declaration, owner, domain, 60); err == nil {
+			t.Error(declaration, "should fail, got", rr)
+		}
+	}
+}
+
+func TestDeclaredRecords(t *testing.T) {
+	s := NewDNSServer(NewConfig())
+
+	records, errs := parseRecordDeclarations(map[string]string{
+		"DNSDOCK_RECORD_1": "MX 10 mail",
+		"DNSDOCK_RECORD_2": "TXT verification-token",
+		"DNSDOCK_RECORD_3": "_dmarc TXT v=DMARC1",
+		"DNSDOCK_RECORD_4": "A 10.0.0.1",
+	}, "mail.postfix.docker.", s.config.domain, 0)
+	if len(records) != 3 || len(errs) != 1 || errs["DNSDOCK_RECORD_4"] == nil {
+		t.Fatal("Expected 3 records and error for DNSDOCK_RECORD_4, got", records, errs)
+	}
+
+	s.AddService("mail", Service{Name: "mail", Image: "postfix", Ip: net.ParseIP("172.17.0.2"), Ttl: -1, Records: records})
+
+	inputs := []struct {
+		query    string
+		qtype    uint16
+		expected int
+		exists   bool
+	}{
+		{"mail.postfix.docker", dns.TypeMX, 1, true},
+		{"MAIL.postfix.docker", dns.TypeMX, 1, true},
+		{"mail.postfix.docker", dns.TypeTXT, 2, true},
+		{"_dmarc.docker", dns.TypeTXT, 1, true},
+		{"_dmarc.docker", dns.TypeMX, 0, true},
+		{"_nothing.docker", dns.TypeTXT, 0, false},
+	}
+
+	for _, input := range inputs {
+		t.Log(input.query, dns.TypeToString[input.qtype])
+		a := s.resolve(input.query, input.qtype, input.query+".", 0)
+		if len(a.Answer) != input.expected || a.Exists != input.exists {
+			t.Error(input, "Got:", a.Answer, a.Exists)
+		}
+	}
+}
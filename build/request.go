@@ -0,0 +1,89 @@
+package main
+
+import (
+	"log"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Question types which make no sense in a query, they're meta records which
+// live only in the additional section (RFC 6891, RFC 2845).
+var invalidQtypes = map[uint16]bool{
+	dns.TypeOPT:  true,
+	dns.TypeTSIG: true,
+	dns.TypeTKEY: true,
+}
+
+// miekg/dns refuses UPDATE messages by default, we check the messages
+// ourselves in checkRequest. Only responses are dropped here, answering them
+// could start a loop with another server.
+func acceptMsg(dh dns.Header) dns.MsgAcceptAction {
+	if isResponse := dh.Bits&(1<<15) != 0; isResponse {
+		return dns.MsgIgnore
+	}
+	return dns.MsgAccept
+}
+
+// Checks that the query can be answered (RFC 1035 4.1.1). Returns RcodeSuccess,
+// or the rcode of the error reply:
+//   - NOTIMP for other opcodes than QUERY (UPDATE is handled separately)
+//   - FORMERR when there isn't exactly one question, or the question is for
+//     a meta type
+//   - REFUSED for other classes than IN at our names, all our data is IN
+//     class. Other names are forwarded as they are.
+func (s *DNSServer) checkRequest(r *dns.Msg) int {
+	if r.Opcode != dns.OpcodeQuery {
+		return dns.RcodeNotImplemented
+	}
+	if len(r.Question) != 1 {
+		return dns.RcodeFormatError
+	}
+	if invalidQtypes[r.Question[0].Qtype] {
+		return dns.RcodeFormatError
+	}
+	if r.Question[0].Qclass != dns.ClassINET && s.isOwnName(strings.TrimSuffix(r.Question[0].Name, ".")) {
+		return dns.RcodeRefused
+	}
+	return dns.RcodeSuccess
+}
+
+// Returns true if we answer the name instead of forwarding it: names in our
+// domain, aliases, CNAMEs and reverse names of the containers. Unlike resolve,
+// it doesn't look up any records, so round-robin doesn't move on.
+func (s *DNSServer) isOwnName(query string) bool {
+	name := strings.ToLower(query)
+	if s.IsLocal(name) {
+		return true
+	}
+
+	defer s.lock.RUnlock()
+	s.lock.RLock()
+
+	if _, ok := s.reverse[name]; ok {
+		return true
+	}
+	if _, ok := s.cnames[name]; ok {
+		return true
+	}
+	if _, ok := s.aliases[name]; ok {
+		return true
+	}
+	return s.matchWildcardAlias(name) != ""
+}
+
+// Sends error reply with the rcode. The question is echoed only if there was
+// exactly one.
+func (s *DNSServer) writeError(w dns.ResponseWriter, r *dns.Msg, rcode int) {
+	m := new(dns.Msg)
+	m.SetRcode(r, rcode)
+	if len(r.Question) != 1 {
+		m.Question = nil
+	}
+	s.setEdns(r, m)
+
+	if s.config.verbose {
+		log.Println("Rejected", dns.OpcodeToString[r.Opcode], "from", w.RemoteAddr(), "with", dns.RcodeToString[rcode])
+	}
+	s.writeMsg(w, r, m)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestCheckRequest(t *testing.T) {
+	s := NewDNSServer(NewConfig())
+
+	question := func(name string, qtype uint16) dns.Question {
+		return dns.Question{Name: name, Qtype: qtype, Qclass: dns.ClassINET}
+	}
+	chaos := func(name string) dns.Question {
+		return dns.Question{Name: name, Qtype: dns.TypeTXT, Qclass: dns.ClassCHAOS}
+	}
+
+	inputs := []struct {
+		opcode    int
+		questions []dns.Question
+		expected  int
+	}{
+		{dns.OpcodeQuery, []dns.Question{question("foo.docker.", dns.TypeA)}, dns.RcodeSuccess},
+		{dns.OpcodeQuery, []dns.Question{question(".", dns.TypeNS)}, dns.RcodeSuccess},
+		{dns.OpcodeQuery, nil, dns.RcodeFormatError},
+		{dns.OpcodeQuery, []dns.Question{question("foo.docker.", dns.TypeA), question("bar.docker.", dns.TypeA)}, dns.RcodeFormatError},
+		{dns.OpcodeQuery, []dns.Question{question("foo.docker.", dns.TypeOPT)}, dns.RcodeFormatError},
+		{dns.OpcodeQuery, []dns.Question{question("foo.docker.", dns.TypeTSIG)}, dns.RcodeFormatError},
+		{dns.OpcodeQuery, []dns.Question{chaos("foo.docker.")}, dns.RcodeRefused},
+		{dns.OpcodeQuery, []dns.Question{chaos("version.bind.")}, dns.RcodeSuccess},
+		{dns.OpcodeNotify, []dns.Question{question("docker.", dns.TypeSOA)}, dns.RcodeNotImplemented},
+		{dns.OpcodeIQuery, []dns.Question{question("foo.docker.", dns.TypeA)}, dns.RcodeNotImplemented},
+		{dns.OpcodeStatus, nil, dns.RcodeNotImplemented},
+	}
+
+	for _, input := range inputs {
+		m := new(dns.Msg)
+		m.Opcode = input.opcode
+		m.Question = input.questions
+		if rcode := s.checkRequest(m); rcode != input.expected {
+			t.Error(dns.OpcodeToString[input.opcode], input.questions, "Expected:", dns.RcodeToString[input.expected], "Got:", dns.RcodeToString[rcode])
+		}
+	}
+}
+
+func TestMalformedRequests(t *testing.T) {
+	const TEST_ADDR = "127.0.0.1:9963"
+
+	config := NewConfig()
+	config.dnsAddr = TEST_ADDR
+
+	server := NewDNSServer(config)
+	go server.Start()
+
+	// Allow some time for server to start
+	time.Sleep(250 * time.Millisecond)
+
+	server.AddService("foo", Service{Name: "foo", Image: "bar", Ip: net.ParseIP("127.0.0.1"), Ttl: -1, Alias: "www.example.com"})
+
+	empty := new(dns.Msg)
+	empty.Id = dns.Id()
+
+	multi := new(dns.Msg)
+	multi.SetQuestion("foo.docker.", dns.TypeA)
+	multi.Question = append(multi.Question, dns.Question{Name: "bar.docker.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+
+	notify := new(dns.Msg)
+	notify.SetNotify("docker.")
+
+	chaos := new(dns.Msg)
+	chaos.SetQuestion("foo.docker.", dns.TypeA)
+	chaos.Question[0].Qclass = dns.ClassCHAOS
+
+	chaosAlias := new(dns.Msg)
+	chaosAlias.SetQuestion("www.example.com.", dns.TypeA)
+	chaosAlias.Question[0].Qclass = dns.ClassCHAOS
+
+	chaosAxfr := new(dns.Msg)
+	chaosAxfr.SetAxfr("docker.")
+	chaosAxfr.Question[0].Qclass = dns.ClassCHAOS
+
+	inputs := []struct {
+		name     string
+		m        *dns.Msg
+		net      string
+		expected int
+	}{
+		{"no question", empty, "udp", dns.RcodeFormatError},
+		{"no question", empty, "tcp", dns.RcodeFormatError},
+		{"two questions", multi, "udp", dns.RcodeFormatError},
+		{"notify", notify, "udp", dns.RcodeNotImplemented},
+		{"chaos class", chaos, "udp", dns.RcodeRefused},
+		{"chaos class alias", chaosAlias, "udp", dns.RcodeRefused},
+		{"chaos class transfer", chaosAxfr, "tcp", dns.RcodeRefused},
+	}
+
+	for _, input := range inputs {
+		c := &dns.Client{Net: input.net}
+		in, _, err := c.Exchange(input.m, TEST_ADDR)
+		if err != nil {
+			t.Error(input.name, "Error response from the server", err)
+			continue
+		}
+		if in.Rcode != input.expected {
+			t.Error(input.name, "Expected:", dns.RcodeToString[input.expected], "Got:", dns.RcodeToString[in.Rcode])
+		}
+		if len(in.Answer) != 0 {
+			t.Error(input.name, "Error reply should have no answer", in.Answer)
+		}
+	}
+
+	// The server is still alive
+	m := new(dns.Msg)
+	m.SetQuestion("foo.bar.docker.", dns.TypeA)
+	in, _, err := new(dns.Client).Exchange(m, TEST_ADDR)
+	if err != nil || len(in.Answer) != 1 {
+		t.Error("Server should still answer", in, err)
+	}
+}
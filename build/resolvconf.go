@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Value of -nameserver which means the nameservers of resolv.conf.
+const resolvConfNameserver = "resolv.conf"
+
+// How often resolv.conf is checked for changes.
+const resolvConfInterval = 2 * time.Second
+
+// Reads nameservers, search domains and options from the resolv.conf file
+// and uses them for forwarding. Returns the content of the file, to check it
+// for changes.
+func (s *DNSServer) loadResolvConf(path string) ([]byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := dns.ClientConfigFromReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []string
+	for _, server := range rc.Servers {
+		addrs = append(addrs, net.JoinHostPort(server, rc.Port))
+	}
+	addrs = s.filterOwnAddresses(addrs)
+
+	var search []string
+	for _, domain := range rc.Search {
+		// Names in our domain are answered by us, not forwarded.
+		if domain = dns.Fqdn(strings.ToLower(domain)); !s.isInZone(domain) {
+			search = append(search, domain)
+		}
+	}
+
+	s.upstreams.set(addrs, time.Duration(rc.Timeout)*time.Second, rc.Attempts)
+	s.upstreams.setSearch(search, rc.Ndots)
+	// Answers of the old nameservers may be different.
+	if s.cache != nil {
+		s.cache.clear()
+	}
+	if s.config.verbose {
+		log.Println("Using nameservers", addrs, "and search domains", search, "from", path)
+	}
+	return content, nil
+}
+
+// Reloads resolv.conf whenever it changes, until the done channel is closed.
+func (s *DNSServer) watchResolvConf(path string, content []byte, done chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(s.resolvConfInterval):
+		}
+
+		current, err := os.ReadFile(path)
+		if err != nil || bytes.Equal(current, content) {
+			continue
+		}
+		if current, err = s.loadResolvConf(path); err != nil {
+			log.Println("Can't reload", path+":", err)
+			continue
+		}
+		content = current
+	}
+}
+
+// Drops the addresses dnscock listens on, forwarding to ourselves would loop.
+// When listening on all interfaces, any local address with our port is ours.
+func (s *DNSServer) filterOwnAddresses(addrs []string) (out []string) {
+	for _, addr := range addrs {
+		if s.isOwnAddress(addr) {
+			log.Println("Not forwarding to", addr+", dnscock listens there")
+			continue
+		}
+		out = append(out, addr)
+	}
+	return
+}
+
+func (s *DNSServer) isOwnAddress(addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	listenHost, listenPort, err := net.SplitHostPort(s.config.dnsAddr)
+	if err != nil || port != listenPort {
+		return false
+	}
+	ip, listenIP := net.ParseIP(host), net.ParseIP(listenHost)
+	if ip == nil {
+		return false
+	}
+	if listenIP != nil && !listenIP.IsUnspecified() {
+		return ip.Equal(listenIP)
+	}
+
+	// Listening on all addresses, only the addresses of the interfaces are
+	// ours. Other loopback addresses may be different servers, e.g. the
+	// embedded DNS of Docker at 127.0.0.11.
+	ifaddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, ifaddr := range ifaddrs {
+		if ipnet, ok := ifaddr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Retries query for a short name which the nameserver didn't find with the
+// search domains, like the resolver of the host would. The answer is a CNAME
+// from the asked name to the expanded one, followed by its records. The CNAME
+// isn't signed, so validating clients (with the DO bit) get the NXDOMAIN of
+// the nameserver. Returns nil when no search domain helped.
+func (s *DNSServer) searchRequest(r *dns.Msg, network string) *dns.Msg {
+	if opt := r.IsEdns0(); opt != nil && opt.Do() {
+		return nil
+	}
+	name := r.Question[0].Name
+	for _, domain := range s.upstreams.getSearch(name) {
+		expanded := name + domain
+		q := r.Copy()
+		q.Question[0].Name = expanded
+		in, err := s.exchange(q, network)
+		if err != nil || in.Rcode != dns.RcodeSuccess || len(in.Answer) == 0 {
+			continue
+		}
+		if s.config.debug {
+			log.Println("Found", name, "as", expanded)
+		}
+		cname := &dns.CNAME{
+			Hdr:    dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: in.Answer[0].Header().Ttl},
+			Target: expanded,
+		}
+		in.Question = r.Question
+		in.Answer = append([]dns.RR{cname}, in.Answer...)
+		return in
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestIsOwnAddress(t *testing.T) {
+	config := NewConfig()
+	s := NewDNSServer(config)
+
+	inputs := []struct {
+		listen string
+		addr   string
+		own    bool
+	}{
+		{"127.0.0.1:53", "127.0.0.1:53", true},
+		{"127.0.0.1:53", "127.0.0.1:5353", false},
+		{"127.0.0.1:53", "10.0.0.1:53", false},
+		{":53", "127.0.0.1:53", true},
+		{":53", "[::1]:53", true},
+		{":53", "8.8.8.8:53", false},
+		{"0.0.0.0:53", "127.0.0.53:53", false},
+		{":53", "127.0.0.11:53", false},
+		{"127.0.0.1:53", "127.0.0.11:53", false},
+	}
+
+	for _, input := range inputs {
+		config.dnsAddr = input.listen
+		if own := s.isOwnAddress(input.addr); own != input.own {
+			t.Error(input, "Expected:", input.own, "Got:", own)
+		}
+	}
+}
+
+func TestLoadResolvConf(t *testing.T) {
+	dir, err := os.MkdirTemp("", "dnscock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "resolv.conf")
+
+	config := NewConfig()
+	config.dnsAddr = "127.0.0.1:53"
+	config.resolvConf = path
+	s := NewDNSServer(config)
+	s.resolvConfInterval = 50 * time.Millisecond
+
+	if err := os.WriteFile(path, []byte("nameserver 10.0.0.1\nnameserver 127.0.0.1\nsearch corp.example docker\noptions timeout:1 attempts:3 ndots:2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	content, err := s.loadResolvConf(path)
+	if err != nil {
+		t.Fatal("Loading failed", err)
+	}
+
+	getAddrs := func() (addrs []string) {
+		for _, up := range s.upstreams.getAlive() {
+			addrs = append(addrs, up.addr)
+		}
+		return
+	}
+
+	// Our own address is left out, and so is our domain from the search
+	if addrs := getAddrs(); !reflect.DeepEqual(addrs, []string{"10.0.0.1:53"}) {
+		t.Error("Expected: [10.0.0.1:53] Got:", addrs)
+	}
+	if search := s.upstreams.getSearch("intranet.example."); !reflect.DeepEqual(search, []string{"corp.example."}) {
+		t.Error("Expected: [corp.example.] Got:", search)
+	}
+	if search := s.upstreams.getSearch("www.intranet.example."); search != nil {
+		t.Error("Name with ndots dots should not be searched, Got:", search)
+	}
+	if s.upstreams.timeout != time.Second || s.upstreams.attempts != 3 {
+		t.Error("Expected timeout 1s and 3 attempts, Got:", s.upstreams.timeout, s.upstreams.attempts)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go s.watchResolvConf(path, content, done)
+
+	if err := os.WriteFile(path, []byte("nameserver 10.0.0.2\nnameserver 10.0.0.3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if addrs := getAddrs(); !reflect.DeepEqual(addrs, []string{"10.0.0.2:53", "10.0.0.3:53"}) {
+		t.Error("Changed resolv.conf should be reloaded, Got:", addrs)
+	}
+}
+
+func TestSearchDomains(t *testing.T) {
+	const (
+		TEST_ADDR     = "127.0.0.1:9970"
+		UPSTREAM_ADDR = "127.0.0.1:9969"
+		NOSEARCH_ADDR = "127.0.0.1:9974"
+	)
+
+	upstream := &dns.Server{Addr: UPSTREAM_ADDR, Net: "udp", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if r.Question[0].Name == "intranet.corp.example." {
+			m.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("10.1.1.1")}}
+		} else {
+			m.Rcode = dns.RcodeNameError
+		}
+		w.WriteMsg(m)
+	})}
+	go upstream.ListenAndServe()
+	defer upstream.Shutdown()
+
+	config := NewConfig()
+	config.dnsAddr = TEST_ADDR
+	config.nameservers = []string{UPSTREAM_ADDR}
+	config.resolvConf = ""
+	config.search = true
+	server := NewDNSServer(config)
+	server.upstreams.setSearch([]string{"other.example.", "corp.example."}, 1)
+	go server.Start()
+	defer server.Stop()
+
+	// Allow some time for servers to start
+	time.Sleep(250 * time.Millisecond)
+
+	m := new(dns.Msg)
+	m.SetQuestion("intranet.", dns.TypeA)
+	in, _, err := new(dns.Client).Exchange(m, TEST_ADDR)
+	if err != nil {
+		t.Fatal("Error response from the server", err)
+	}
+	if in.Rcode != dns.RcodeSuccess || len(in.Answer) != 2 || in.Question[0].Name != "intranet." {
+		t.Fatal("Expected CNAME and A, Got:", in)
+	}
+	if cname, ok := in.Answer[0].(*dns.CNAME); !ok || cname.Hdr.Name != "intranet." || cname.Target != "intranet.corp.example." {
+		t.Error("Expected CNAME to the expanded name, Got:", in.Answer[0])
+	}
+
+	m.SetQuestion("missing.", dns.TypeA)
+	if in, _, err = new(dns.Client).Exchange(m, TEST_ADDR); err != nil || in.Rcode != dns.RcodeNameError {
+		t.Error("Expected NXDOMAIN when no search domain helps, Got:", in, err)
+	}
+
+	// Validating clients would reject the unsigned CNAME
+	m.SetQuestion("intranet.", dns.TypeA)
+	m.SetEdns0(4096, true)
+	if in, _, err = new(dns.Client).Exchange(m, TEST_ADDR); err != nil || in.Rcode != dns.RcodeNameError {
+		t.Error("Expected NXDOMAIN for DO request, Got:", in, err)
+	}
+
+	// Search domains are used only when enabled
+	config = NewConfig()
+	config.dnsAddr = NOSEARCH_ADDR
+	config.nameservers = []string{UPSTREAM_ADDR}
+	config.resolvConf = ""
+	nosearch := NewDNSServer(config)
+	nosearch.upstreams.setSearch([]string{"corp.example."}, 1)
+	go nosearch.Start()
+	defer nosearch.Stop()
+	time.Sleep(250 * time.Millisecond)
+
+	m = new(dns.Msg)
+	m.SetQuestion("intranet.", dns.TypeA)
+	if in, _, err = new(dns.Client).Exchange(m, NOSEARCH_ADDR); err != nil || in.Rcode != dns.RcodeNameError {
+		t.Error("Expected NXDOMAIN without -search, Got:", in, err)
+	}
+}
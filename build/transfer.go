@@ -0,0 +1,259 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Number of records sent in one message of a zone transfer.
+const transferChunkSize = 100
+
+// Returns true if the client address is in one of the networks allowed to
+// transfer the zone.
+func (s *DNSServer) isTransferAllowed(addr net.Addr) bool {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		return false
+	}
+	for _, network := range s.config.allowTransfer {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks whether the name belongs to the zone we serve.
+func (s *DNSServer) isInZone(name string) bool {
+	return dns.IsSubDomain(dns.Fqdn(s.config.domain.String()), dns.Fqdn(strings.ToLower(name)))
+}
+
+// Returns the names the service is answered by: the apex, the image name and
+// its parent parts, the container name under the image, the canonical name
+// and the wildcard below it, e.g. "docker.", "bar.docker.", "foo.bar.docker."
+// and "*.foo.bar.docker.".
+func (s *DNSServer) getServiceNames(service *Service) []string {
+	canonical := s.getCanonicalName(service)
+	if service.Image == "" {
+		return []string{canonical}
+	}
+	domain := dns.Fqdn(s.config.domain.String())
+	names := []string{domain, "*." + canonical}
+	for parts := strings.Split(service.Image, "."); len(parts) > 0; parts = parts[1:] {
+		names = append(names, strings.Join(parts, ".")+"."+domain)
+	}
+	for parts := strings.Split(service.Name, "."); len(parts) > 0; parts = parts[1:] {
+		names = append(names, strings.Join(parts, ".")+"."+service.Image+"."+domain)
+	}
+	return names
+}
+
+// Returns all the records of the zone except SOA: NS and glue, A, AAAA and
+// TXT records of every name the containers are answered by (the apex, image
+// names, canonical names and wildcards below them), SRV records of exposed
+// ports, records declared by the containers, A and AAAA records of aliases,
+// CNAME aliases and the dynamic records. Containers failing their healthcheck
+// are included, secondaries can't leave them out when they recover. Aliases
+// outside of the zone are left out, secondaries would ignore them anyway.
+// Caller must hold the lock.
+func (s *DNSServer) getZoneRecords() []dns.RR {
+	records := s.createNS()
+	if s.isInZone(s.getNSName()) {
+		records = append(records, s.createGlue(dns.TypeA)...)
+		records = append(records, s.createGlue(dns.TypeAAAA)...)
+	}
+
+	names := make(map[string]bool)
+	for _, service := range s.services {
+		for _, name := range s.getServiceNames(service) {
+			names[name] = true
+		}
+	}
+	for name := range names {
+		labels := strings.Split(strings.TrimSuffix(name, "."), ".")
+		for _, service := range s.services {
+			if name != s.getCanonicalName(service) && !s.matchesService(labels, service) {
+				continue
+			}
+			for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+				if rr := getServiceRecord(service, name, qtype, s.config.ttl); rr != nil {
+					records = append(records, rr)
+				}
+			}
+			if s.config.txt {
+				records = append(records, s.getTXTRecord(service, name))
+			}
+		}
+	}
+
+	for _, service := range s.services {
+		name := s.getCanonicalName(service)
+		records = append(records, service.Records...)
+		for _, port := range service.Ports {
+			labels := []string{"_" + strconv.Itoa(int(port.Port))}
+			if port.Name != "" {
+				labels = append(labels, "_"+strings.ToLower(port.Name))
+			}
+			for _, label := range labels {
+				records = append(records, s.getSRVRecord(service, port, label+"._"+port.Protocol+"."+name))
+			}
+		}
+	}
+
+	for alias, id_map := range s.aliases {
+		if !s.isInZone(alias) {
+			continue
+		}
+		for service_id := range id_map {
+			for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+				if rr := getServiceRecord(s.services[service_id], dns.Fqdn(alias), qtype, s.config.ttl); rr != nil {
+					records = append(records, rr)
+				}
+			}
+		}
+	}
+
+	for name := range s.cnames {
+		if !s.isInZone(name) {
+			continue
+		}
+		if cname := s.createCname(name, dns.Fqdn(name)); cname != nil {
+			records = append(records, cname)
+		}
+	}
+
+	for _, rrs := range s.dynamic {
+		records = append(records, rrs...)
+	}
+
+	return dns.Dedup(records, nil)
+}
+
+// Returns a consistent snapshot of the zone for a transfer, starting and
+// ending with the SOA.
+func (s *DNSServer) getZoneSnapshot() []dns.RR {
+	defer s.lock.RUnlock()
+	s.lock.RLock()
+
+	soa := s.createSOA()
+	records := append(soa, s.getZoneRecords()...)
+	return append(records, soa...)
+}
+
+// Returns the records of an incremental transfer from the serial, as in RFC
+// 1995: the current SOA, then for every change the old SOA, removed records,
+// the new SOA and added records, and the current SOA again. If the client is
+// up to date, only the current SOA is returned. When the journal doesn't
+// reach back to the serial, the full zone is returned like for AXFR.
+func (s *DNSServer) getIncrementalSnapshot(serial uint32) []dns.RR {
+	defer s.lock.RUnlock()
+	s.lock.RLock()
+
+	soa := s.createSOA()
+	if serial == soa[0].(*dns.SOA).Serial {
+		return soa
+	}
+
+	entries, ok := s.getJournalSince(serial)
+	if !ok {
+		if s.config.verbose {
+			log.Println("Journal doesn't reach serial", serial, "sending full zone")
+		}
+		records := append(soa, s.getZoneRecords()...)
+		return append(records, soa...)
+	}
+
+	records := soa
+	for _, entry := range entries {
+		records = append(records, s.createSOAWithSerial(entry.From))
+		records = append(records, entry.Removed...)
+		records = append(records, s.createSOAWithSerial(entry.To))
+		records = append(records, entry.Added...)
+	}
+	return append(records, soa...)
+}
+
+func (s *DNSServer) createSOAWithSerial(serial uint32) dns.RR {
+	soa := s.createSOA()[0].(*dns.SOA)
+	soa.Serial = serial
+	return soa
+}
+
+// Answers AXFR and IXFR requests for the zone. Transfers are allowed only to
+// the networks from the allow-transfer list, and only over TCP. IXFR over UDP
+// gets just the current SOA so that the client retries over TCP.
+func (s *DNSServer) handleTransfer(w dns.ResponseWriter, r *dns.Msg) {
+	_, isTCP := w.RemoteAddr().(*net.TCPAddr)
+	qtype := r.Question[0].Qtype
+	if (!isTCP && qtype == dns.TypeAXFR) || !s.isTransferAllowed(w.RemoteAddr()) || r.Question[0].Qclass != dns.ClassINET ||
+		!strings.EqualFold(dns.Fqdn(r.Question[0].Name), dns.Fqdn(s.config.domain.String())) {
+		if s.config.verbose {
+			log.Println("Refused zone transfer of", r.Question[0].Name, "to", w.RemoteAddr())
+		}
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeRefused)
+		w.WriteMsg(m)
+		return
+	}
+
+	if !isTCP {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Authoritative = true
+		m.Answer = s.createSOA()
+		w.WriteMsg(m)
+		return
+	}
+
+	var records []dns.RR
+	if qtype == dns.TypeIXFR {
+		var client *dns.SOA
+		if len(r.Ns) > 0 {
+			client, _ = r.Ns[0].(*dns.SOA)
+		}
+		if client == nil {
+			m := new(dns.Msg)
+			m.SetRcode(r, dns.RcodeFormatError)
+			w.WriteMsg(m)
+			return
+		}
+		records = s.getIncrementalSnapshot(client.Serial)
+	} else {
+		records = s.getZoneSnapshot()
+	}
+
+	if s.config.verbose {
+		log.Println(dns.TypeToString[qtype], "to", w.RemoteAddr(), "with", len(records), "records")
+	}
+	s.sendTransfer(w, r, records)
+}
+
+// Streams the records to the client in chunks and closes the connection.
+func (s *DNSServer) sendTransfer(w dns.ResponseWriter, r *dns.Msg, records []dns.RR) {
+	defer w.Close()
+
+	for len(records) > 0 {
+		n := transferChunkSize
+		if n > len(records) {
+			n = len(records)
+		}
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Authoritative = true
+		m.Answer = records[:n]
+		if err := w.WriteMsg(m); err != nil {
+			log.Println("Zone transfer to", w.RemoteAddr(), "failed:", err)
+			return
+		}
+		records = records[n:]
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestZoneRecords(t *testing.T) {
+	config := NewConfig()
+	config.nsName = "ns1.docker"
+	config.nsAddr = "10.0.0.53"
+	s := NewDNSServer(config)
+
+	s.AddService("foo", Service{Name: "foo", Image: "bar", Ip: net.ParseIP("172.17.0.2"), Ipv6: net.ParseIP("2001:db8::2"), Ttl: -1,
+		Alias: "api.docker,www.seznam.cz", Ports: []ServicePort{{"http", 80, "tcp"}}, Meta: ServiceMeta{Id: "foo"}})
+	s.AddService("baz", Service{Name: "baz", Image: "bar", Ip: net.ParseIP("172.17.0.3"), Ttl: -1, Meta: ServiceMeta{Id: "baz"}})
+
+	expected := map[string]int{
+		"docker. NS":                     1,
+		"ns1.docker. A":                  1,
+		"foo.bar.docker. A":              1,
+		"foo.bar.docker. AAAA":           1,
+		"foo.bar.docker. TXT":            1,
+		"_80._tcp.foo.bar.docker. SRV":   1,
+		"_http._tcp.foo.bar.docker. SRV": 1,
+		"baz.bar.docker. A":              1,
+		"baz.bar.docker. TXT":            1,
+		// names shared by more containers and wildcards below the names
+		"docker. A":              2,
+		"docker. AAAA":           1,
+		"docker. TXT":            2,
+		"bar.docker. A":          2,
+		"bar.docker. AAAA":       1,
+		"bar.docker. TXT":        2,
+		"*.foo.bar.docker. A":    1,
+		"*.foo.bar.docker. AAAA": 1,
+		"*.foo.bar.docker. TXT":  1,
+		"*.baz.bar.docker. A":    1,
+		"*.baz.bar.docker. TXT":  1,
+		"api.docker. A":          1,
+		"api.docker. AAAA":       1,
+	}
+
+	actual := make(map[string]int)
+	for _, rr := range s.getZoneRecords() {
+		actual[rr.Header().Name+" "+dns.TypeToString[rr.Header().Rrtype]]++
+	}
+
+	if len(actual) != len(expected) {
+		t.Error("Expected:", expected, "Got:", actual)
+	}
+	for key, count := range expected {
+		if actual[key] != count {
+			t.Error(key, "Expected:", count, "Got:", actual[key])
+		}
+	}
+}
+
+func TestZoneTransfer(t *testing.T) {
+	const TEST_ADDR = "127.0.0.1:9957"
+
+	config := NewConfig()
+	config.dnsAddr = TEST_ADDR
+
+	server := NewDNSServer(config)
+	go server.Start()
+
+	// Allow some time for server to start
+	time.Sleep(250 * time.Millisecond)
+
+	for i := 0; i < 150; i++ {
+		ip := net.IPv4(172, 17, byte(i/250), byte(i%250+2))
+		server.AddService(ip.String(), Service{Name: "web" + strconv.Itoa(i), Image: "bar", Ip: ip, Ttl: -1})
+	}
+
+	m := new(dns.Msg)
+	m.SetAxfr("docker.")
+
+	transfer := func() (records []dns.RR, err error) {
+		tr := new(dns.Transfer)
+		envelopes, err := tr.In(m, TEST_ADDR)
+		if err != nil {
+			return nil, err
+		}
+		for envelope := range envelopes {
+			if envelope.Error != nil {
+				return nil, envelope.Error
+			}
+			records = append(records, envelope.RR...)
+		}
+		return records, nil
+	}
+
+	if _, err := transfer(); err == nil {
+		t.Error("Transfer should be refused when the client is not allowed")
+	}
+
+	config.allowTransfer, _ = ParseNetworks("127.0.0.0/8")
+
+	records, err := transfer()
+	if err != nil {
+		t.Fatal("Transfer failed", err)
+	}
+	// SOA, NS, A and TXT records of 150 canonical names and of the wildcards
+	// below them, 150 A records and TXT of the apex and of the image name
+	// (same metadata, one TXT record), SOA
+	if len(records) != 905 {
+		t.Error("Expected: 905 Got:", len(records))
+	}
+	if _, ok := records[0].(*dns.SOA); !ok {
+		t.Error("Transfer should start with SOA")
+	}
+	if _, ok := records[len(records)-1].(*dns.SOA); !ok {
+		t.Error("Transfer should end with SOA")
+	}
+
+	m.SetAxfr("example.com.")
+	if _, err := transfer(); err == nil {
+		t.Error("Transfer of foreign zone should be refused")
+	}
+}
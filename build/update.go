@@ -0,0 +1,282 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Record types which can be managed with dynamic updates.
+var updatableTypes = map[uint16]bool{
+	dns.TypeA:     true,
+	dns.TypeAAAA:  true,
+	dns.TypeCNAME: true,
+	dns.TypeTXT:   true,
+}
+
+// Key of a name in the dynamic records map: lowercase, without trailing dot.
+func dynamicKey(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// Returns dynamic records matching the query, renamed to qname. Names match
+// like container names: parts can be left out from the left side and "*"
+// matches any part. If the exact name has a CNAME, the CNAME is returned for
+// queries of other types.
+func (s *DNSServer) getDynamicRecords(query string, qtype uint16, qname string) (records []dns.RR) {
+	defer s.lock.RUnlock()
+	s.lock.RLock()
+
+	query = dynamicKey(query)
+	labels := strings.Split(query, ".")
+	for name, rrs := range s.dynamic {
+		if matches, _ := matchSuffix(labels, strings.Split(name, ".")); !matches {
+			continue
+		}
+		for _, rr := range rrs {
+			rrtype := rr.Header().Rrtype
+			if rrtype == qtype || (rrtype == dns.TypeCNAME && name == query) {
+				rr = dns.Copy(rr)
+				rr.Header().Name = qname
+				records = append(records, rr)
+			}
+		}
+	}
+	return
+}
+
+// Returns true if any dynamic record matches the query.
+func (s *DNSServer) hasDynamicName(query string) bool {
+	defer s.lock.RUnlock()
+	s.lock.RLock()
+
+	labels := strings.Split(dynamicKey(query), ".")
+	for name := range s.dynamic {
+		if matches, _ := matchSuffix(labels, strings.Split(name, ".")); matches {
+			return true
+		}
+	}
+	return false
+}
+
+// Handles RFC 2136 UPDATE messages. Only messages signed with one of the
+// configured TSIG keys are accepted, and only A, AAAA, CNAME and TXT records
+// within our domain can be changed.
+func (s *DNSServer) handleUpdate(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+
+	rcode := s.checkUpdate(w, r)
+	if rcode == dns.RcodeSuccess {
+		rcode = s.applyUpdate(r)
+	}
+	m.Rcode = rcode
+
+	if s.config.verbose {
+		log.Println("Update from", w.RemoteAddr(), "result", dns.RcodeToString[rcode])
+	}
+
+	if t := r.IsTsig(); t != nil && w.TsigStatus() == nil {
+		m.SetTsig(t.Hdr.Name, t.Algorithm, 300, time.Now().Unix())
+	}
+	w.WriteMsg(m)
+}
+
+// Checks the signature, the zone and the update section of the message.
+func (s *DNSServer) checkUpdate(w dns.ResponseWriter, r *dns.Msg) int {
+	t := r.IsTsig()
+	if t == nil {
+		log.Println("Refused unsigned update from", w.RemoteAddr())
+		return dns.RcodeRefused
+	}
+	if _, ok := s.config.tsigKeys[strings.ToLower(t.Hdr.Name)]; !ok || w.TsigStatus() != nil {
+		log.Println("Refused update from", w.RemoteAddr(), "with invalid signature:", w.TsigStatus())
+		return dns.RcodeNotAuth
+	}
+
+	if len(r.Question) != 1 || r.Question[0].Qtype != dns.TypeSOA {
+		return dns.RcodeFormatError
+	}
+	if !strings.EqualFold(dns.Fqdn(r.Question[0].Name), dns.Fqdn(s.config.domain.String())) {
+		return dns.RcodeNotAuth
+	}
+
+	for _, rr := range append(r.Answer, r.Ns...) {
+		if !s.isInZone(rr.Header().Name) {
+			return dns.RcodeNotZone
+		}
+	}
+
+	for _, rr := range r.Ns {
+		hdr := rr.Header()
+		switch hdr.Class {
+		case dns.ClassINET:
+			if !updatableTypes[hdr.Rrtype] {
+				log.Println("Refused update of", dns.TypeToString[hdr.Rrtype], "record", hdr.Name)
+				return dns.RcodeRefused
+			}
+		case dns.ClassANY:
+			if hdr.Ttl != 0 || (hdr.Rrtype != dns.TypeANY && !updatableTypes[hdr.Rrtype]) {
+				return dns.RcodeFormatError
+			}
+		case dns.ClassNONE:
+			if hdr.Ttl != 0 || !updatableTypes[hdr.Rrtype] {
+				return dns.RcodeFormatError
+			}
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// Checks the prerequisite section of the update (RFC 2136 3.2). Caller must
+// hold the lock.
+func (s *DNSServer) checkPrerequisites(prereqs []dns.RR) int {
+	values := make(map[string][]dns.RR)
+	for _, rr := range prereqs {
+		hdr := rr.Header()
+		name := dynamicKey(hdr.Name)
+		rrs := s.dynamic[name]
+		switch hdr.Class {
+		case dns.ClassANY:
+			if hdr.Rrtype == dns.TypeANY {
+				if len(rrs) == 0 {
+					return dns.RcodeNameError
+				}
+			} else if len(filterRecords(rrs, hdr.Rrtype)) == 0 {
+				return dns.RcodeNXRrset
+			}
+		case dns.ClassNONE:
+			if hdr.Rrtype == dns.TypeANY {
+				if len(rrs) != 0 {
+					return dns.RcodeYXDomain
+				}
+			} else if len(filterRecords(rrs, hdr.Rrtype)) != 0 {
+				return dns.RcodeYXRrset
+			}
+		case dns.ClassINET:
+			key := name + "/" + dns.TypeToString[hdr.Rrtype]
+			values[key] = append(values[key], rr)
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+
+	// Value dependent prerequisites: the RRset must be exactly the same.
+	for key, expected := range values {
+		name := key[:strings.LastIndex(key, "/")]
+		actual := filterRecords(s.dynamic[name], expected[0].Header().Rrtype)
+		if removed, added := diffRecords(normalizeRecords(actual), normalizeRecords(expected)); len(removed) != 0 || len(added) != 0 {
+			return dns.RcodeNXRrset
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// Checks the prerequisites and applies the update section to the dynamic
+// records.
+func (s *DNSServer) applyUpdate(r *dns.Msg) int {
+	defer s.lock.Unlock()
+	s.lock.Lock()
+
+	if rcode := s.checkPrerequisites(r.Answer); rcode != dns.RcodeSuccess {
+		return rcode
+	}
+
+	before := s.getJournalSnapshot()
+	changed := false
+	for _, rr := range r.Ns {
+		hdr := rr.Header()
+		name := dynamicKey(hdr.Name)
+		old := s.dynamic[name]
+		rrs := append([]dns.RR(nil), old...)
+
+		switch hdr.Class {
+		case dns.ClassINET:
+			// CNAME can't live next to other data (RFC 2136 3.4.2.2), dynamic
+			// or container records
+			if len(filterRecords(rrs, dns.TypeCNAME)) != 0 && hdr.Rrtype != dns.TypeCNAME {
+				continue
+			}
+			if (len(rrs) != 0 && len(filterRecords(rrs, dns.TypeCNAME)) == 0 || s.hasContainerData(name)) && hdr.Rrtype == dns.TypeCNAME {
+				continue
+			}
+			rr = dns.Copy(rr)
+			rr.Header().Name = dns.Fqdn(name)
+			if hdr.Rrtype == dns.TypeCNAME {
+				// there can be only one CNAME for the name
+				rrs = nil
+			}
+			replaced := false
+			for i := range rrs {
+				if dns.IsDuplicate(rrs[i], rr) {
+					rrs[i] = rr
+					replaced = true
+				}
+			}
+			if !replaced {
+				rrs = append(rrs, rr)
+			}
+		case dns.ClassANY:
+			if hdr.Rrtype == dns.TypeANY {
+				rrs = nil
+			} else {
+				rrs = removeRecords(rrs, func(old dns.RR) bool { return old.Header().Rrtype == hdr.Rrtype })
+			}
+		case dns.ClassNONE:
+			match := dns.Copy(rr)
+			match.Header().Class = dns.ClassINET
+			rrs = removeRecords(rrs, func(old dns.RR) bool { return dns.IsDuplicate(old, match) })
+		}
+
+		if removed, added := diffRecords(old, rrs); len(removed) == 0 && len(added) == 0 {
+			continue
+		}
+		if len(rrs) == 0 {
+			delete(s.dynamic, name)
+		} else {
+			s.dynamic[name] = rrs
+		}
+		changed = true
+	}
+
+	if changed {
+		s.commitChange(before)
+	}
+	return dns.RcodeSuccess
+}
+
+// Returns the records of the type.
+func filterRecords(rrs []dns.RR, rrtype uint16) (out []dns.RR) {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == rrtype {
+			out = append(out, rr)
+		}
+	}
+	return
+}
+
+// Returns new slice without the records for which remove returns true.
+func removeRecords(rrs []dns.RR, remove func(dns.RR) bool) (out []dns.RR) {
+	for _, rr := range rrs {
+		if !remove(rr) {
+			out = append(out, rr)
+		}
+	}
+	return
+}
+
+// Returns copies of the records with lowercase names and zero TTL, for
+// comparisons.
+func normalizeRecords(rrs []dns.RR) (out []dns.RR) {
+	for _, rr := range rrs {
+		rr = dns.Copy(rr)
+		rr.Header().Name = strings.ToLower(rr.Header().Name)
+		rr.Header().Ttl = 0
+		out = append(out, rr)
+	}
+	return
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestDynamicUpdate(t *testing.T) {
+	const TEST_ADDR = "127.0.0.1:9961"
+	const KEY = "update.key."
+	const SECRET = "c2VjcmV0c2VjcmV0c2VjcmV0"
+
+	config := NewConfig()
+	config.dnsAddr = TEST_ADDR
+	config.tsigKeys = map[string]string{KEY: SECRET}
+
+	server := NewDNSServer(config)
+	go server.Start()
+
+	// Allow some time for server to start
+	time.Sleep(250 * time.Millisecond)
+
+	server.AddService("foo", Service{Name: "foo", Image: "bar", Ip: net.ParseIP("172.17.0.2"), Ttl: -1})
+
+	rr := func(s string) dns.RR {
+		r, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	update := func(signed bool, zone string, prereqs []dns.RR, insert []dns.RR, remove []dns.RR) int {
+		m := new(dns.Msg)
+		m.SetUpdate(zone)
+		m.Answer = prereqs
+		m.Insert(insert)
+		m.Remove(remove)
+		c := new(dns.Client)
+		if signed {
+			c.TsigSecret = map[string]string{KEY: SECRET}
+			m.SetTsig(KEY, dns.HmacSHA256, 300, time.Now().Unix())
+		}
+		in, _, err := c.Exchange(m, TEST_ADDR)
+		if err != nil {
+			t.Fatal("Error response from the server", err)
+		}
+		return in.Rcode
+	}
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		in, _, err := new(dns.Client).Exchange(m, TEST_ADDR)
+		if err != nil {
+			t.Fatal("Error response from the server", err)
+		}
+		return in
+	}
+
+	vm := rr("vm1.docker. 60 IN A 10.0.0.1")
+
+	if rcode := update(false, "docker.", nil, []dns.RR{vm}, nil); rcode != dns.RcodeRefused {
+		t.Error("Unsigned update should be refused, got", dns.RcodeToString[rcode])
+	}
+	if rcode := update(true, "docker.", nil, []dns.RR{rr("vm1.example.com. 60 IN A 10.0.0.1")}, nil); rcode != dns.RcodeNotZone {
+		t.Error("Update outside of zone should fail, got", dns.RcodeToString[rcode])
+	}
+	if rcode := update(true, "docker.", nil, []dns.RR{rr("vm1.docker. 60 IN MX 10 mail.docker.")}, nil); rcode != dns.RcodeRefused {
+		t.Error("Update of MX should be refused, got", dns.RcodeToString[rcode])
+	}
+
+	serial := server.getSerial()
+	if rcode := update(true, "docker.", nil, []dns.RR{vm, rr("vm1.docker. 60 IN TXT \"hello\"")}, nil); rcode != dns.RcodeSuccess {
+		t.Fatal("Update failed", dns.RcodeToString[rcode])
+	}
+	if server.getSerial() == serial {
+		t.Error("Serial should change after update")
+	}
+
+	if in := query("vm1.docker.", dns.TypeA); len(in.Answer) != 1 {
+		t.Error("Expected A record of vm1, got", in)
+	}
+	if in := query("VM1.docker.", dns.TypeTXT); len(in.Answer) != 1 {
+		t.Error("Expected TXT record of vm1, got", in)
+	}
+	if in := query("*.docker.", dns.TypeA); len(in.Answer) != 2 {
+		t.Error("Wildcard should match both container and vm1, got", in.Answer)
+	}
+	if in := query("vm1.docker.", dns.TypeAAAA); len(in.Answer) != 0 || in.Rcode != dns.RcodeSuccess {
+		t.Error("Expected NODATA for AAAA of vm1, got", in)
+	}
+
+	// prerequisite: vm1 must not exist, but it does, so vm2 is not added
+	if rcode := update(true, "docker.", []dns.RR{rr("vm1.docker. 0 NONE ANY")}, []dns.RR{rr("vm2.docker. 60 IN A 10.0.0.2")}, nil); rcode != dns.RcodeYXDomain {
+		t.Error("Prerequisite should fail, got", dns.RcodeToString[rcode])
+	}
+
+	// CNAME can't be added next to A
+	update(true, "docker.", nil, []dns.RR{rr("vm1.docker. 60 IN CNAME foo.bar.docker.")}, nil)
+	if in := query("vm1.docker.", dns.TypeCNAME); len(in.Answer) != 0 {
+		t.Error("CNAME should have been ignored, got", in.Answer)
+	}
+
+	// nor next to container records
+	update(true, "docker.", nil, []dns.RR{rr("foo.bar.docker. 60 IN CNAME api.docker.")}, nil)
+	if in := query("foo.bar.docker.", dns.TypeA); len(in.Answer) != 1 || in.Answer[0].Header().Rrtype != dns.TypeA {
+		t.Error("CNAME next to a container should have been ignored, got", in.Answer)
+	}
+	if rrs := server.getDynamicRecords("foo.bar.docker.", dns.TypeCNAME, "foo.bar.docker."); len(rrs) != 0 {
+		t.Error("CNAME next to a container should not be stored, got", rrs)
+	}
+
+	if rcode := update(true, "docker.", nil, []dns.RR{rr("api.docker. 60 IN CNAME foo.bar.docker.")}, nil); rcode != dns.RcodeSuccess {
+		t.Fatal("Update failed", dns.RcodeToString[rcode])
+	}
+	if in := query("api.docker.", dns.TypeA); len(in.Answer) == 0 || in.Answer[0].Header().Rrtype != dns.TypeCNAME {
+		t.Error("Expected CNAME for A query, got", in.Answer)
+	}
+
+	// records are part of the zone
+	found := 0
+	for _, rr := range server.getZoneSnapshot() {
+		if rr.Header().Name == "vm1.docker." || rr.Header().Name == "api.docker." {
+			found++
+		}
+	}
+	if found != 3 {
+		t.Error("Dynamic records should be in the zone, found", found)
+	}
+
+	if rcode := update(true, "docker.", nil, nil, []dns.RR{rr("vm1.docker. 0 IN A 10.0.0.1")}); rcode != dns.RcodeSuccess {
+		t.Fatal("Update failed", dns.RcodeToString[rcode])
+	}
+	if in := query("vm1.docker.", dns.TypeA); len(in.Answer) != 0 {
+		t.Error("A record of vm1 should be deleted, got", in.Answer)
+	}
+
+	serial = server.getSerial()
+	if rcode := update(true, "docker.", nil, nil, nil); rcode != dns.RcodeSuccess {
+		t.Error("Empty update should succeed, got", dns.RcodeToString[rcode])
+	}
+	if server.getSerial() != serial {
+		t.Error("Serial should not change after empty update")
+	}
+
+	m := new(dns.Msg)
+	m.SetUpdate("docker.")
+	m.RemoveName([]dns.RR{rr("vm1.docker. 0 IN A 0.0.0.0")})
+	m.RemoveName([]dns.RR{rr("api.docker. 0 IN A 0.0.0.0")})
+	c := &dns.Client{TsigSecret: map[string]string{KEY: SECRET}}
+	m.SetTsig(KEY, dns.HmacSHA256, 300, time.Now().Unix())
+	if in, _, err := c.Exchange(m, TEST_ADDR); err != nil || in.Rcode != dns.RcodeSuccess {
+		t.Fatal("Delete of names failed", err, in)
+	}
+	if in := query("vm1.docker.", dns.TypeTXT); in.Rcode != dns.RcodeNameError {
+		t.Error("vm1 should not exist anymore, got", in)
+	}
+	server.lock.RLock()
+	if len(server.dynamic) != 0 {
+		t.Error("dynamic records should be empty", server.dynamic)
+	}
+	server.lock.RUnlock()
+}
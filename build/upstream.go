@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Strategies for forwarding to more nameservers.
+const (
+	forwardSequential = "sequential"
+	forwardParallel   = "parallel"
+)
+
+// Nameserver failing this many times in a row is skipped for upstreamDownTime.
+const (
+	upstreamMaxFailures = 3
+	upstreamDownTime    = 30 * time.Second
+)
+
+// Upstream nameserver with its health: consecutive failures, the time until
+// which it's skipped, and the average round trip time of the last answers.
+type upstream struct {
+	addr      string
+	failures  int
+	downUntil time.Time
+	rtt       time.Duration
+}
+
+// Upstream nameservers for forwarded queries. Timeout, attempts and the
+// search domains come from resolv.conf, zero means the defaults of the DNS
+// client and one attempt.
+type upstreams struct {
+	lock     sync.Mutex
+	list     []*upstream
+	strategy string
+	timeout  time.Duration
+	attempts int
+	search   []string
+	ndots    int
+}
+
+func newUpstreams(addrs []string, strategy string) *upstreams {
+	u := &upstreams{strategy: strategy}
+	u.set(addrs, 0, 0)
+	return u
+}
+
+// Replaces the nameservers. Nameservers which stay keep their health.
+func (u *upstreams) set(addrs []string, timeout time.Duration, attempts int) {
+	defer u.lock.Unlock()
+	u.lock.Lock()
+
+	old := make(map[string]*upstream, len(u.list))
+	for _, up := range u.list {
+		old[up.addr] = up
+	}
+	u.list = nil
+	for _, addr := range addrs {
+		if up, ok := old[addr]; ok {
+			u.list = append(u.list, up)
+		} else {
+			u.list = append(u.list, &upstream{addr: addr})
+		}
+	}
+	u.timeout = timeout
+	u.attempts = attempts
+}
+
+func (u *upstreams) setSearch(search []string, ndots int) {
+	defer u.lock.Unlock()
+	u.lock.Lock()
+
+	u.search = search
+	u.ndots = ndots
+}
+
+// Returns the search domains to try for the name, when it has less dots than
+// ndots (e.g. "intranet." with ndots 1).
+func (u *upstreams) getSearch(name string) []string {
+	defer u.lock.Unlock()
+	u.lock.Lock()
+
+	if labels := dns.CountLabel(name); labels == 0 || labels-1 >= u.ndots {
+		return nil
+	}
+	return u.search
+}
+
+// Returns the nameservers which are not skipped, in the configured order. If
+// all of them are down, all are returned, trying a dead server is better than
+// not trying at all.
+func (u *upstreams) getAlive() []*upstream {
+	defer u.lock.Unlock()
+	u.lock.Lock()
+
+	if len(u.list) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	var alive []*upstream
+	for _, up := range u.list {
+		if now.After(up.downUntil) {
+			alive = append(alive, up)
+		}
+	}
+	if len(alive) == 0 {
+		alive = append(alive, u.list...)
+	}
+	return alive
+}
+
+// Records the result of a query to the nameserver.
+func (u *upstreams) report(up *upstream, rtt time.Duration, err error) {
+	defer u.lock.Unlock()
+	u.lock.Lock()
+
+	if err != nil {
+		up.failures++
+		if up.failures >= upstreamMaxFailures {
+			if time.Now().After(up.downUntil) {
+				log.Println("Nameserver", up.addr, "failed", up.failures, "times, skipping it for", upstreamDownTime)
+			}
+			up.downUntil = time.Now().Add(upstreamDownTime)
+		}
+		return
+	}
+	up.failures = 0
+	up.downUntil = time.Time{}
+	if up.rtt == 0 {
+		up.rtt = rtt
+	} else {
+		up.rtt = (up.rtt*7 + rtt) / 8
+	}
+}
+
+// Sends the request to one nameserver. SERVFAIL and REFUSED count as
+// failures, another nameserver may know better.
+func (u *upstreams) exchangeWith(up *upstream, r *dns.Msg, network string) (*dns.Msg, error) {
+	u.lock.Lock()
+	c := &dns.Client{Net: network, Timeout: u.timeout}
+	u.lock.Unlock()
+	in, rtt, err := c.Exchange(r, up.addr)
+	if err == nil && (in.Rcode == dns.RcodeServerFailure || in.Rcode == dns.RcodeRefused) {
+		err = errors.New(up.addr + " answered " + dns.RcodeToString[in.Rcode])
+	}
+	u.report(up, rtt, err)
+	return in, err
+}
+
+// Forwards the request by the strategy, as many times as the attempts allow.
+// Returns error when none of the nameservers answered.
+func (u *upstreams) exchange(r *dns.Msg, network string) (in *dns.Msg, err error) {
+	u.lock.Lock()
+	attempts := u.attempts
+	u.lock.Unlock()
+
+	for i := 0; i < attempts || i == 0; i++ {
+		alive := u.getAlive()
+		if len(alive) == 0 {
+			return nil, errors.New("No nameservers configured")
+		}
+		if in, err = u.exchangeOnce(alive, r, network); err == nil {
+			return in, nil
+		}
+	}
+	return nil, err
+}
+
+// Sequential strategy tries the nameservers one after another until one
+// answers, parallel asks all of them at once and takes the first answer.
+func (u *upstreams) exchangeOnce(alive []*upstream, r *dns.Msg, network string) (*dns.Msg, error) {
+	if u.strategy == forwardParallel && len(alive) > 1 {
+		type result struct {
+			in  *dns.Msg
+			err error
+		}
+		results := make(chan result, len(alive))
+		for _, up := range alive {
+			go func(up *upstream) {
+				// Every goroutine packs the message, give each its own.
+				in, err := u.exchangeWith(up, r.Copy(), network)
+				results <- result{in, err}
+			}(up)
+		}
+		var err error
+		for range alive {
+			res := <-results
+			if res.err == nil {
+				return res.in, nil
+			}
+			err = res.err
+		}
+		return nil, err
+	}
+
+	var err error
+	for _, up := range alive {
+		var in *dns.Msg
+		if in, err = u.exchangeWith(up, r, network); err == nil {
+			return in, nil
+		}
+		log.Println("Forwarding to", up.addr, "failed:", err)
+	}
+	return nil, err
+}
+
+// Logs the health of the nameservers, for print-status.
+func (u *upstreams) logStatus() {
+	defer u.lock.Unlock()
+	u.lock.Lock()
+
+	for _, up := range u.list {
+		state := "up"
+		if time.Now().Before(up.downUntil) {
+			state = "down until " + up.downUntil.Format(time.RFC3339)
+		}
+		log.Println("nameserver:", up.addr, state, "failures:", up.failures, "rtt:", up.rtt)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Starts nameserver which answers every A query with the address, or with
+// the rcode if the address is nil.
+func startUpstream(addr string, ip net.IP, rcode int) *dns.Server {
+	server := &dns.Server{Addr: addr, Net: "udp", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetRcode(r, rcode)
+		if ip != nil {
+			m.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET}, A: ip}}
+		}
+		w.WriteMsg(m)
+	})}
+	go server.ListenAndServe()
+	return server
+}
+
+func TestUpstreams(t *testing.T) {
+	const (
+		GOOD_ADDR    = "127.0.0.1:9965"
+		FAILING_ADDR = "127.0.0.1:9966"
+		// nothing listens there
+		DEAD_ADDR = "127.0.0.1:9968"
+	)
+
+	good := startUpstream(GOOD_ADDR, net.ParseIP("10.0.0.1"), dns.RcodeSuccess)
+	defer good.Shutdown()
+	failing := startUpstream(FAILING_ADDR, nil, dns.RcodeServerFailure)
+	defer failing.Shutdown()
+
+	// Allow some time for servers to start
+	time.Sleep(250 * time.Millisecond)
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+
+	for _, strategy := range []string{forwardSequential, forwardParallel} {
+		u := newUpstreams([]string{DEAD_ADDR, FAILING_ADDR, GOOD_ADDR}, strategy)
+		for i := 0; i < upstreamMaxFailures; i++ {
+			in, err := u.exchange(m, "udp")
+			if err != nil || len(in.Answer) != 1 {
+				t.Fatal(strategy, "Expected answer from the good nameserver, Got:", in, err)
+			}
+		}
+
+		// The failing ones are skipped now. Parallel exchange doesn't wait for
+		// the slower failures.
+		time.Sleep(100 * time.Millisecond)
+		alive := u.getAlive()
+		if len(alive) != 1 || alive[0].addr != GOOD_ADDR {
+			t.Error(strategy, "Expected only the good nameserver alive, Got:", alive)
+		}
+		if alive[0].rtt == 0 {
+			t.Error(strategy, "Round trip time should be tracked")
+		}
+	}
+
+	u := newUpstreams([]string{DEAD_ADDR, FAILING_ADDR}, forwardSequential)
+	if _, err := u.exchange(m, "udp"); err == nil {
+		t.Error("Exchange should fail when no nameserver answers")
+	}
+	for i := 0; i < upstreamMaxFailures; i++ {
+		u.exchange(m, "udp")
+	}
+	// All of them are down, they're tried anyway
+	if alive := u.getAlive(); len(alive) != 2 {
+		t.Error("Expected all nameservers when all are down, Got:", alive)
+	}
+}
+
+func TestForwardServfail(t *testing.T) {
+	const TEST_ADDR = "127.0.0.1:9967"
+
+	config := NewConfig()
+	config.dnsAddr = TEST_ADDR
+	config.nameservers = []string{"127.0.0.1:9968"}
+	config.resolvConf = ""
+
+	server := NewDNSServer(config)
+	go server.Start()
+	defer server.Stop()
+
+	// Allow some time for server to start
+	time.Sleep(250 * time.Millisecond)
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	in, _, err := new(dns.Client).Exchange(m, TEST_ADDR)
+	if err != nil {
+		t.Fatal("Error response from the server", err)
+	}
+	if in.Rcode != dns.RcodeServerFailure {
+		t.Error("Expected: SERVFAIL Got:", dns.RcodeToString[in.Rcode])
+	}
+}